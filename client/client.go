@@ -0,0 +1,514 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/config"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the client routes every key by the same config the nodes use, so requests go straight to the
+// leader of the key's shard instead of through whichever node is at hand
+//   - a read the leader does not answer is tried on the shard's replicas in turn
+//   - a write goes to a replica only when the leader can't be reached at all, e.g. after a failover,
+//     the replica passes it on to whoever leads the shard now
+//   - a request that failed for lack of a node or a disagreement about the topology is retried
+//     after a backoff
+//   - answers carry the epoch of the node asked and the leader that served a proxied request, a newer
+//     epoch or a topology mismatch makes the client fetch the layout from /cluster/topology,
+//     a different leader is remembered until the next layout
+
+const (
+	epochHeader = "X-KV-Topology-Epoch"
+	ownerHeader = "X-KV-Shard-Owner"
+)
+
+// ErrNotFound is returned for a key that does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// StatusError is an error answer of a node.
+type StatusError struct {
+	Addr    string
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s answered %d: %s", e.Addr, e.Code, e.Message)
+}
+
+const (
+	DefaultTimeout      = 10 * time.Second // longer than a node waits for replica acks by default
+	DefaultRetries      = 2
+	DefaultRetryBackoff = 100 * time.Millisecond
+	DefaultBatchWorkers = 16
+)
+
+type Options struct {
+	HTTPClient   *http.Client  // default: pooled connections and Timeout per attempt
+	Timeout      time.Duration // how long one attempt may take with the default HTTPClient, default 10s
+	Retries      int           // how often a failed request is tried again, default 2, negative for never
+	RetryBackoff time.Duration // wait before the first retry, doubled for every next one, default 100ms
+	BatchWorkers int           // how many operations of a Batch run at once, default 16
+
+	// MaxStaleness is how far behind its leader a replica may be to serve a read the leader did not answer,
+	// 0 leaves it to the replica's -max-staleness.
+	MaxStaleness time.Duration
+}
+
+// KeyValue is a key and its value as Scan returns them.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+type OpKind int
+
+const (
+	OpSet OpKind = iota
+	OpDelete
+)
+
+// Op is one operation of a Batch.
+type Op struct {
+	Kind  OpKind
+	Key   string
+	Value []byte // for OpSet
+}
+
+// Client talks to a kv cluster, it is safe for concurrent use.
+type Client struct {
+	opts Options
+	hc   *http.Client
+
+	mu      sync.Mutex
+	shards  *config.Shards
+	leaders map[int]string // leaders that took over from the ones in the config
+}
+
+// New returns a client for the cluster described by c.
+func New(c config.Config, opts Options) (*Client, error) {
+	shards, err := config.ParseLayout(c)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.BatchWorkers <= 0 {
+		opts.BatchWorkers = DefaultBatchWorkers
+	}
+	hc := opts.HTTPClient
+	if hc == nil {
+		hc = &http.Client{
+			Timeout: opts.Timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         (&net.Dialer{Timeout: opts.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConnsPerHost: 64,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	}
+	return &Client{opts: opts, hc: hc, shards: shards, leaders: make(map[int]string)}, nil
+}
+
+// NewFromFile returns a client for the cluster described by the config file at path.
+func NewFromFile(path string, opts Options) (*Client, error) {
+	c, err := config.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(c, opts)
+}
+
+// Epoch returns the topology epoch the client routes by.
+func (c *Client) Epoch() uint64 {
+	return c.topology().Epoch
+}
+
+func (c *Client) topology() *config.Shards {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shards
+}
+
+// nodes returns the nodes of shard, the leader first
+func (c *Client) nodes(shards *config.Shards, shard int) []string {
+	c.mu.Lock()
+	leader, ok := c.leaders[shard]
+	c.mu.Unlock()
+	if !ok {
+		leader = shards.Addrs[shard]
+	}
+	res := []string{leader}
+	for _, addr := range append([]string{shards.Addrs[shard]}, shards.Replicas[shard]...) {
+		if addr != leader {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// Refresh fetches the layout from the first node that answers and routes by it if it is not older.
+func (c *Client) Refresh(ctx context.Context) error {
+	shards := c.topology()
+	var errs []error
+	for idx := 0; idx < shards.Count; idx++ {
+		for _, addr := range append([]string{shards.Addrs[idx]}, shards.Replicas[idx]...) {
+			err := c.refreshFrom(ctx, addr)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+	}
+	return fmt.Errorf("no node returned the topology: %w", errors.Join(errs...))
+}
+
+func (c *Client) refreshFrom(ctx context.Context, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/cluster/topology", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Addr: addr, Code: resp.StatusCode, Message: "fetching the topology"}
+	}
+
+	var cfg config.Config
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		return fmt.Errorf("decoding the topology of %q: %w", addr, err)
+	}
+	next, err := config.ParseLayout(cfg)
+	if err != nil {
+		return fmt.Errorf("topology of %q: %w", addr, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if next.Epoch < c.shards.Epoch {
+		return nil
+	}
+	c.shards = next
+	c.leaders = make(map[int]string)
+	return nil
+}
+
+// observe learns from the headers of an answer of addr to a request for shard
+func (c *Client) observe(ctx context.Context, shards *config.Shards, shard int, addr string, h http.Header) {
+	if owner := h.Get(ownerHeader); owner != "" && owner != addr {
+		c.mu.Lock()
+		if c.shards == shards {
+			c.leaders[shard] = owner
+		}
+		c.mu.Unlock()
+	}
+	if epoch, err := strconv.ParseUint(h.Get(epochHeader), 10, 64); err == nil && epoch > shards.Epoch {
+		// best effort, a failed fetch is tried again on the next newer epoch
+		c.refreshFrom(ctx, addr)
+	}
+}
+
+// retryable tells whether a request that failed with err may succeed on another try
+func retryable(err error) bool {
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	var se *StatusError
+	if !errors.As(err, &se) {
+		// the node did not answer
+		return true
+	}
+	switch se.Code {
+	case http.StatusMisdirectedRequest, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// call sends a request for the shard route picks, retrying as the options allow,
+// ok lists the statuses that count as success, the body of the answer is returned for them
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body []byte, read bool, route func(*config.Shards) int, ok ...int) ([]byte, int, error) {
+	backoff := c.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		shards := c.topology()
+		shard := route(shards)
+		res, status, err := c.tryNodes(ctx, shards, shard, method, path, query, body, read, ok)
+		if err == nil || attempt >= c.opts.Retries || !retryable(err) {
+			return res, status, err
+		}
+		if method == http.MethodDelete && mayHaveApplied(err) {
+			// a delete that went through would come back as not found
+			return res, status, err
+		}
+
+		var se *StatusError
+		if errors.As(err, &se) && se.Code == http.StatusMisdirectedRequest {
+			c.Refresh(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, fmt.Errorf("%w, last error: %w", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// tryNodes sends the request to the nodes of shard in turn until one of them answers it
+func (c *Client) tryNodes(ctx context.Context, shards *config.Shards, shard int, method, path string, query url.Values, body []byte, read bool, ok []int) ([]byte, int, error) {
+	var err error
+	nodes := c.nodes(shards, shard)
+	for i, addr := range nodes {
+		q := query
+		if read && i > 0 && c.opts.MaxStaleness > 0 {
+			q = url.Values{}
+			for k, v := range query {
+				q[k] = v
+			}
+			q.Set("max_staleness", c.opts.MaxStaleness.String())
+		}
+		var res []byte
+		var status int
+		res, status, err = c.send(ctx, shards, shard, addr, method, path, q, body, ok)
+		if err == nil && !read && i > 0 {
+			c.tookWrite(shards, shard, nodes[0], addr)
+		}
+		// a write moves on only if it never reached the leader, anything else may have applied it
+		if err == nil || !retryable(err) || !read && !notSent(err) {
+			return res, status, err
+		}
+	}
+	return nil, 0, err
+}
+
+// tookWrite remembers addr as the leader of shard after it served a write the leader could not be sent,
+// unless it named another leader in its answer
+func (c *Client) tookWrite(shards *config.Shards, shard int, unreachable, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shards != shards {
+		return
+	}
+	if leader, ok := c.leaders[shard]; !ok || leader == unreachable {
+		c.leaders[shard] = addr
+	}
+}
+
+// notSent tells whether a request failed before it reached the node
+func notSent(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// mayHaveApplied tells whether a request that failed with err may still have been applied,
+// because it reached the node but no answer came back
+func mayHaveApplied(err error) bool {
+	var se *StatusError
+	return !errors.As(err, &se) && !notSent(err)
+}
+
+func (c *Client) send(ctx context.Context, shards *config.Shards, shard int, addr, method, path string, query url.Values, body []byte, ok []int) ([]byte, int, error) {
+	u := "http://" + addr + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	c.observe(ctx, shards, shard, addr, resp.Header)
+
+	res, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading the answer of %q: %w", addr, err)
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return res, resp.StatusCode, nil
+		}
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, resp.StatusCode, ErrNotFound
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(res, &e) != nil || e.Error == "" {
+		e.Error = string(res)
+	}
+	return nil, resp.StatusCode, &StatusError{Addr: addr, Code: resp.StatusCode, Message: e.Error}
+}
+
+func keyPath(key string) string {
+	return "/v1/keys/" + url.PathEscape(key)
+}
+
+func routeKey(key string) func(*config.Shards) int {
+	return func(shards *config.Shards) int { return shards.Index(key) }
+}
+
+// Get returns the value of key, ErrNotFound if it does not exist.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("empty key")
+	}
+	value, _, err := c.call(ctx, http.MethodGet, keyPath(key), nil, nil, true, routeKey(key), http.StatusOK)
+	return value, err
+}
+
+// Set stores value under key.
+func (c *Client) Set(ctx context.Context, key string, value []byte) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	_, _, err := c.call(ctx, http.MethodPut, keyPath(key), nil, value, false, routeKey(key), http.StatusCreated, http.StatusNoContent)
+	return err
+}
+
+// Delete removes key, ErrNotFound if it did not exist.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	_, _, err := c.call(ctx, http.MethodDelete, keyPath(key), nil, nil, false, routeKey(key), http.StatusNoContent)
+	return err
+}
+
+// Scan returns up to limit keys with their values in key order, from start up to but not including end.
+// An empty end is open ended, a limit <= 0 means no limit. Every shard that may hold keys of the range
+// is scanned, the result is not a snapshot: writes during the scan may or may not show up.
+func (c *Client) Scan(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+	shards := c.topology()
+	var idxs []int
+	for idx := 0; idx < shards.Count; idx++ {
+		if shards.MayHold(idx, start, end) {
+			idxs = append(idxs, idx)
+		}
+	}
+
+	results := make([][]KeyValue, len(idxs))
+	errs := make([]error, len(idxs))
+	var wg sync.WaitGroup
+	for i, idx := range idxs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.scanShard(ctx, idx, start, end, limit)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	// during a split the new shard answers with its parent's keys, which the parent returns too
+	seen := make(map[string]bool)
+	var res []KeyValue
+	for _, kvs := range results {
+		for _, kv := range kvs {
+			if !seen[kv.Key] {
+				seen[kv.Key] = true
+				res = append(res, kv)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+// scanShard pages through the keys of shard idx
+func (c *Client) scanShard(ctx context.Context, idx int, start, end string, limit int) ([]KeyValue, error) {
+	var res []KeyValue
+	for {
+		q := url.Values{"start": {start}}
+		if end != "" {
+			q.Set("end", end)
+		}
+		if limit > 0 {
+			q.Set("limit", strconv.Itoa(limit-len(res)))
+		}
+		body, _, err := c.call(ctx, http.MethodGet, "/v1/keys", q, nil, true, func(*config.Shards) int { return idx }, http.StatusOK)
+		if err != nil {
+			return nil, fmt.Errorf("scanning shard %d: %w", idx, err)
+		}
+		var page struct {
+			Entries []struct {
+				Key   string `json:"key"`
+				Value []byte `json:"value"`
+			} `json:"entries"`
+			Next string `json:"next"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("decoding a scan page of shard %d: %w", idx, err)
+		}
+		for _, e := range page.Entries {
+			res = append(res, KeyValue{Key: e.Key, Value: e.Value})
+		}
+		if page.Next == "" || (limit > 0 && len(res) >= limit) {
+			return res, nil
+		}
+		start = page.Next
+	}
+}
+
+// Batch applies ops, BatchWorkers at a time, each to the leader of its key's shard.
+// A batch is not atomic: every op succeeds or fails on its own, the error joins the failed ones.
+func (c *Client) Batch(ctx context.Context, ops []Op) error {
+	errs := make([]error, len(ops))
+	sem := make(chan struct{}, c.opts.BatchWorkers)
+	var wg sync.WaitGroup
+	for i, op := range ops {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			var err error
+			switch op.Kind {
+			case OpSet:
+				err = c.Set(ctx, op.Key, op.Value)
+			case OpDelete:
+				err = c.Delete(ctx, op.Key)
+			default:
+				err = fmt.Errorf("unknown op kind %d", op.Kind)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("key %q: %w", op.Key, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,318 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"kv/client"
+	"kv/config"
+	"kv/db"
+	"kv/failover"
+	"kv/replication"
+	"kv/transport"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// node is one kv server of a test cluster
+type node struct {
+	srv  *transport.Server
+	db   *db.Database
+	ts   *httptest.Server
+	addr string
+	hits atomic.Int32 // requests to /v1/keys
+}
+
+func newNode(t *testing.T) *node {
+	t.Helper()
+
+	n := &node{}
+	mux := http.NewServeMux()
+	keys := func(h func(*transport.Server, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			n.hits.Add(1)
+			h(n.srv, w, r)
+		}
+	}
+	mux.HandleFunc("GET /v1/keys", keys((*transport.Server).ScanHandler))
+	mux.HandleFunc("GET /v1/keys/{key...}", keys((*transport.Server).GetKeyHandler))
+	mux.HandleFunc("PUT /v1/keys/{key...}", keys((*transport.Server).PutKeyHandler))
+	mux.HandleFunc("DELETE /v1/keys/{key...}", keys((*transport.Server).DeleteKeyHandler))
+	mux.HandleFunc("/cluster/topology", func(w http.ResponseWriter, r *http.Request) { n.srv.TopologyHandler(w, r) })
+	mux.HandleFunc("/next-replication-key", func(w http.ResponseWriter, r *http.Request) { n.srv.GetNextKeyForReplication(w, r) })
+	mux.HandleFunc("/delete-replication-key", func(w http.ResponseWriter, r *http.Request) { n.srv.DeleteReplicationKey(w, r) })
+	mux.HandleFunc("/replication/snapshot", func(w http.ResponseWriter, r *http.Request) { n.srv.SnapshotHandler(w, r) })
+	mux.HandleFunc("/failover/state", func(w http.ResponseWriter, r *http.Request) { n.srv.FailoverStateHandler(w, r) })
+	n.ts = httptest.NewServer(mux)
+	t.Cleanup(n.ts.Close)
+	n.addr = strings.TrimPrefix(n.ts.URL, "http://")
+	return n
+}
+
+// start opens the node's database and serves shard name of c
+func (n *node) start(t *testing.T, c config.Config, name string, replica bool) {
+	t.Helper()
+
+	database, closeFn, err := db.NewDatabase(t.TempDir()+"/db.bolt", replica)
+	require.NoError(t, err)
+	t.Cleanup(func() { closeFn() })
+	shards, err := config.ParseConfig(c, name)
+	require.NoError(t, err)
+	n.db = database
+	n.srv = transport.NewServer(database, shards, name)
+}
+
+// cluster starts two shards, the second one with a replica pulling from its leader
+func cluster(t *testing.T) (config.Config, []*node) {
+	t.Helper()
+
+	nodes := []*node{newNode(t), newNode(t), newNode(t)}
+	c := config.Config{Epoch: 1, Shards: []config.Shard{
+		{Name: "a", Idx: 0, Address: nodes[0].addr},
+		{Name: "b", Idx: 1, Address: nodes[1].addr, Replicas: []string{nodes[2].addr}},
+	}}
+	nodes[0].start(t, c, "a", false)
+	nodes[1].start(t, c, "b", false)
+	nodes[2].start(t, c, "b", true)
+
+	rc, err := replication.NewClient(nodes[2].db, nodes[1].addr, replication.Options{ReplicaID: nodes[2].addr, LongPollWait: 100 * time.Millisecond})
+	require.NoError(t, err)
+	go rc.Run()
+	t.Cleanup(rc.Stop)
+	nodes[2].srv.SetReplicationClient(rc)
+	return c, nodes
+}
+
+// failoverCluster starts one shard with two replicas that take over when the leader goes away
+func failoverCluster(t *testing.T) (config.Config, []*node) {
+	t.Helper()
+
+	nodes := []*node{newNode(t), newNode(t), newNode(t)}
+	c := config.Config{Epoch: 1, Shards: []config.Shard{
+		{Name: "a", Idx: 0, Address: nodes[0].addr, Replicas: []string{nodes[1].addr, nodes[2].addr}},
+	}}
+	for i, n := range nodes {
+		n.start(t, c, "a", i > 0)
+		shards, err := config.ParseConfig(c, "a")
+		require.NoError(t, err)
+		f, err := failover.NewNode(n.db, failover.NewDirectory(shards), 0, failover.Options{
+			Self:                n.addr,
+			LeaseTimeout:        300 * time.Millisecond,
+			Replication:         replication.Options{LongPollWait: 100 * time.Millisecond},
+			OnReplicationClient: n.srv.SetReplicationClient,
+		})
+		require.NoError(t, err)
+		n.srv.SetFailover(f)
+		require.NoError(t, f.Start())
+		t.Cleanup(f.Stop)
+	}
+	return c, nodes
+}
+
+// keyOf returns a key of the given shard under c
+func keyOf(t *testing.T, c config.Config, shard int, prefix string) string {
+	t.Helper()
+
+	shards, err := config.ParseLayout(c)
+	require.NoError(t, err)
+	for i := 0; ; i++ {
+		if key := fmt.Sprintf("%s-%d", prefix, i); shards.Index(key) == shard {
+			return key
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	c, nodes := cluster(t)
+	cl, err := client.New(c, client.Options{})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// every key goes straight to its shard
+	key0, key1 := keyOf(t, c, 0, "user/a"), keyOf(t, c, 1, "user/b")
+	require.NoError(t, cl.Set(ctx, key0, []byte("v0")))
+	require.NoError(t, cl.Set(ctx, key1, []byte("v1\x00")))
+	require.Equal(t, int32(1), nodes[0].hits.Load())
+	require.Equal(t, int32(1), nodes[1].hits.Load())
+	stored, err := nodes[1].db.GetKey(key1)
+	require.NoError(t, err)
+	require.Equal(t, "v1\x00", string(stored))
+
+	// the leader spreads reads over its replica too
+	require.Eventually(t, func() bool {
+		_, err := nodes[2].db.GetKey(key1)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	value, err := cl.Get(ctx, key1)
+	require.NoError(t, err)
+	require.Equal(t, "v1\x00", string(value))
+
+	_, err = cl.Get(ctx, key0+"-missing")
+	require.ErrorIs(t, err, client.ErrNotFound)
+
+	require.NoError(t, cl.Delete(ctx, key0))
+	require.ErrorIs(t, cl.Delete(ctx, key0), client.ErrNotFound)
+	_, err = cl.Get(ctx, key0)
+	require.ErrorIs(t, err, client.ErrNotFound)
+
+	var ops []client.Op
+	for i := 0; i < 10; i++ {
+		ops = append(ops, client.Op{Kind: client.OpSet, Key: fmt.Sprintf("batch-%02d", i), Value: []byte(fmt.Sprint(i))})
+	}
+	ops = append(ops, client.Op{Kind: client.OpDelete, Key: key1})
+	require.NoError(t, cl.Batch(ctx, ops))
+	require.Eventually(t, func() bool {
+		_, err := nodes[2].db.GetKey(key1)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = cl.Get(ctx, key1)
+	require.ErrorIs(t, err, client.ErrNotFound)
+
+	err = cl.Batch(ctx, []client.Op{{Kind: client.OpDelete, Key: "never-set"}, {Kind: client.OpSet, Key: "ok", Value: []byte("v")}})
+	require.ErrorIs(t, err, client.ErrNotFound)
+	require.Contains(t, err.Error(), `"never-set"`)
+
+	// a scan merges every shard in key order
+	kvs, err := cl.Scan(ctx, "batch-", "batch-~", 0)
+	require.NoError(t, err)
+	require.Len(t, kvs, 10)
+	for i, kv := range kvs {
+		require.Equal(t, fmt.Sprintf("batch-%02d", i), kv.Key)
+		require.Equal(t, fmt.Sprint(i), string(kv.Value))
+	}
+	kvs, err = cl.Scan(ctx, "batch-03", "", 3)
+	require.NoError(t, err)
+	require.Equal(t, []client.KeyValue{
+		{Key: "batch-03", Value: []byte("3")},
+		{Key: "batch-04", Value: []byte("4")},
+		{Key: "batch-05", Value: []byte("5")},
+	}, kvs)
+}
+
+func TestClient_ReadFailover(t *testing.T) {
+	c, nodes := cluster(t)
+	cl, err := client.New(c, client.Options{MaxStaleness: time.Hour, Retries: -1})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	key := keyOf(t, c, 1, "k")
+	require.NoError(t, cl.Set(ctx, key, []byte("v")))
+	require.Eventually(t, func() bool {
+		_, err := nodes[2].db.GetKey(key)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the leader goes away, reads go on from the replica, writes fail
+	nodes[1].ts.Close()
+	value, err := cl.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, "v", string(value))
+	require.Error(t, cl.Set(ctx, key, []byte("w")))
+}
+
+func TestClient_TopologyRefresh(t *testing.T) {
+	c, nodes := cluster(t)
+
+	// the client starts out with an older layout that has the shards the other way round
+	stale := config.Config{Shards: []config.Shard{
+		{Name: "a", Idx: 0, Address: nodes[1].addr, Replicas: []string{nodes[2].addr}},
+		{Name: "b", Idx: 1, Address: nodes[0].addr},
+	}}
+	cl, err := client.New(stale, client.Options{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), cl.Epoch())
+	ctx := context.Background()
+
+	// the first write goes to the wrong node, which passes it on and tells the client its epoch
+	key := keyOf(t, c, 0, "k")
+	require.NoError(t, cl.Set(ctx, key, []byte("v")))
+	_, err = nodes[0].db.GetKey(key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), cl.Epoch())
+
+	// from then on it goes straight to the owner
+	before := nodes[1].hits.Load()
+	value, err := cl.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, "v", string(value))
+	require.Equal(t, before, nodes[1].hits.Load())
+
+	require.NoError(t, cl.Refresh(ctx))
+	require.Equal(t, uint64(1), cl.Epoch())
+}
+
+func TestClient_WriteAfterFailover(t *testing.T) {
+	c, nodes := failoverCluster(t)
+	cl, err := client.New(c, client.Options{})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	require.NoError(t, cl.Set(ctx, "before", []byte("v")))
+
+	// the configured leader goes away and a replica takes over, the config still names the old one
+	nodes[0].ts.Close()
+	var leader *node
+	require.Eventually(t, func() bool {
+		for _, n := range nodes[1:] {
+			if !n.db.ReadOnly() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a client that only writes finds the new leader through a replica
+	require.NoError(t, cl.Set(ctx, "after", []byte("v")))
+	_, err = leader.db.GetKey("after")
+	require.NoError(t, err)
+
+	// and sends the next writes there directly
+	for _, n := range nodes[1:] {
+		n.hits.Store(0)
+	}
+	require.NoError(t, cl.Set(ctx, "after-2", []byte("v")))
+	require.NoError(t, cl.Delete(ctx, "after"))
+	for _, n := range nodes[1:] {
+		if n == leader {
+			require.EqualValues(t, 2, n.hits.Load())
+		} else {
+			require.Zero(t, n.hits.Load())
+		}
+	}
+}
+
+func TestClient_SlowWrite(t *testing.T) {
+	var puts, deletes atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// applies the write, then answers after the client gave up
+		if r.Method == http.MethodDelete {
+			deletes.Add(1)
+		} else {
+			puts.Add(1)
+		}
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(ts.Close)
+
+	c := config.Config{Shards: []config.Shard{{Name: "a", Idx: 0, Address: strings.TrimPrefix(ts.URL, "http://")}}}
+	cl, err := client.New(c, client.Options{Timeout: 50 * time.Millisecond, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// a set is tried again, it does the same the second time
+	require.Error(t, cl.Set(ctx, "k", []byte("v")))
+	require.EqualValues(t, 3, puts.Load())
+
+	// a delete is not, a retry would report the key it just removed as not found
+	err = cl.Delete(ctx, "k")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, client.ErrNotFound)
+	require.EqualValues(t, 1, deletes.Load())
+}
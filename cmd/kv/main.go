@@ -1,23 +1,45 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"kv/config"
 	"kv/db"
+	"kv/failover"
+	"kv/membership"
 	"kv/replication"
 	"kv/transport"
+
+	"google.golang.org/grpc"
 )
 
 // command line flags
 var (
-	dbLocation = flag.String("db-location", "", "Path to the BoltDB file for this shard")
-	httpAddr   = flag.String("http-addr", "127.0.0.1:8080", "Address this HTTP server should listen on")
-	configFile = flag.String("config-file", "sharding.toml", "Path to the TOML config defining all shards")
-	shardName  = flag.String("shard", "", "Name of the current shard (must match one in config)")
-	replica    = flag.Bool("replica", false, "Run in read-only replica mode (pull from leader)")
+	dbLocation   = flag.String("db-location", "", "Path to the BoltDB file for this shard")
+	httpAddr     = flag.String("http-addr", "127.0.0.1:8080", "Address this HTTP server should listen on")
+	configFile   = flag.String("config-file", "sharding.toml", "Path to the TOML config defining all shards")
+	shardName    = flag.String("shard", "", "Name of the current shard, only needed when -http-addr is not listed in the config")
+	replica      = flag.Bool("replica", false, "Run in read-only replica mode (pull from leader), only needed when -http-addr is not listed in the config")
+	batchSize    = flag.Int("replication-batch-size", replication.DefaultBatchSize, "Max number of log entries a replica pulls from the leader per round trip")
+	longPoll     = flag.Duration("replication-long-poll", 2*time.Second, "How long the leader may hold a replica's pull open waiting for new writes, 0 to poll every 100ms. An idle replica is up to this far behind, keep it below -max-staleness")
+	leaseTimeout = flag.Duration("failover-lease", 3*time.Second, "How long a shard leader takes writes without hearing from enough replicas, replicas take over after twice that, 0 disables automatic failover")
+	durability   = flag.String("durability", "async", "How many replicas must ack a write before it is answered when the request does not say: async, one, quorum or all")
+	durableWait  = flag.Duration("durability-timeout", 5*time.Second, "How long a write may wait for its replica acks before failing")
+	configPoll   = flag.Duration("config-poll", 5*time.Second, "How often to check the config file for changes, 0 only reloads on SIGHUP or /admin/reload")
+	gossipEvery  = flag.Duration("gossip-interval", membership.DefaultProbeInterval, "How often this node pings another one to detect failed nodes, 0 disables gossip membership")
+	suspectWait  = flag.Duration("gossip-suspect-timeout", membership.DefaultSuspectTimeout, "How long an unreachable node stays suspect before it is considered dead")
+	forwardWait  = flag.Duration("forward-timeout", transport.DefaultForwardTimeout, "How long a request passed on to another node may wait for it to start answering")
+	routing      = flag.String("routing", "proxy", "What to do with requests for a shard this node does not lead when the request does not say: proxy passes them on, redirect answers 307 to the leader")
+	maxValueSize = flag.Int64("max-value-size", transport.DefaultMaxValueSize, "Largest value in bytes a PUT to /v1/keys may store")
+	maxStaleness = flag.Duration("max-staleness", transport.DefaultMaxStaleness, "How far behind the leader a replica may be to serve a read that does not set max_staleness, 0 sends all reads to the leader")
 )
 
 func parseFlags() {
@@ -26,8 +48,11 @@ func parseFlags() {
 	if *dbLocation == "" {
 		log.Fatalf("Must provide --db-location")
 	}
-	if *shardName == "" {
-		log.Fatalf("Must provide --shard (e.g. Hyderabad, Bangalore)")
+	if _, err := replication.ParseDurability(*durability); err != nil {
+		log.Fatalf("Invalid --durability: %v", err)
+	}
+	if _, err := transport.ParseRoutingMode(*routing); err != nil {
+		log.Fatalf("Invalid --routing: %v", err)
 	}
 }
 
@@ -40,13 +65,28 @@ func main() {
 		log.Fatalf("Error parsing config file %q: %v", *configFile, err)
 	}
 
+	// the config tells which shard we belong to and whether we are a replica from our own address
+	// -shard and -replica are only the fallback for addresses the config does not list, e.g. 0.0.0.0:8080
+	if name, isReplica, err := config.Locate(cfg.Shards, *httpAddr); err == nil {
+		if *shardName != "" && *shardName != name {
+			log.Fatalf("--shard=%s but %s belongs to shard %q in %q", *shardName, *httpAddr, name, *configFile)
+		}
+		if *replica && !isReplica {
+			log.Fatalf("--replica but %s leads shard %q in %q", *httpAddr, name, *configFile)
+		}
+		*shardName = name
+		*replica = isReplica
+	} else if *shardName == "" {
+		log.Fatalf("Must provide --shard (e.g. Hyderabad, Bangalore): %v", err)
+	}
+
 	// Extract current shard's index, address, and global shard map
-	shards, err := config.ParseShards(cfg.Shards, *shardName)
+	shards, err := config.ParseConfig(cfg, *shardName)
 	if err != nil {
 		log.Fatalf("Error parsing shard metadata: %v", err)
 	}
 
-	log.Printf("Loaded shard config: %q (Index: %d) | Total shards: %d", *shardName, shards.CurIdx, shards.Count)
+	log.Printf("Loaded shard config: %q (Index: %d) | Total shards: %d | Topology epoch: %d", *shardName, shards.CurIdx, shards.Count, shards.Epoch)
 
 	// Open BoltDB (read-only if --replica)
 	dbInstance, closeFn, err := db.NewDatabase(*dbLocation, *replica)
@@ -55,14 +95,22 @@ func main() {
 	}
 	defer closeFn()
 
-	// If this is a replica, start replication client loop
 	if *replica {
-		leaderAddr, ok := shards.Addrs[shards.CurIdx]
-		if !ok {
-			log.Fatalf("Could not determine leader address for shard %d", shards.CurIdx)
+		log.Printf("Running in replica mode — syncing from leader %q", shards.Addrs[shards.CurIdx])
+	}
+
+	// a shard added by a split copies its parent until the parent cuts over, once
+	splitParent := ""
+	if parent, ok := shards.SplitParent(shards.CurIdx); ok && !*replica {
+		done, err := dbInstance.SplitDone()
+		if err != nil {
+			log.Fatalf("Failed to read split state: %v", err)
+		}
+		if !done {
+			splitParent = shards.Addrs[parent]
+			dbInstance.SetReadOnly(true)
+			log.Printf("New shard split off shard %d — copying keys from %q until it cuts over", parent, splitParent)
 		}
-		log.Printf("Running in replica mode — syncing from leader %q", leaderAddr)
-		go replication.ClientLoop(dbInstance, leaderAddr)
 	}
 
 	shorthand := map[string]string{
@@ -82,13 +130,124 @@ func main() {
 
 	// Create HTTP server handlers
 	srv := transport.NewServer(dbInstance, shards, label)
+	srv.SetDurability(replication.Durability(*durability), *durableWait)
+	srv.SetMaxStaleness(*maxStaleness)
+	srv.SetMaxValueSize(*maxValueSize)
+	srv.SetForwardTimeout(*forwardWait)
+	routingMode, _ := transport.ParseRoutingMode(*routing)
+	srv.SetRoutingMode(routingMode)
+	srv.SetConfigFile(*configFile, *shardName)
+
+	dir := failover.NewDirectory(shards)
+	var members *membership.List
+	if *gossipEvery > 0 {
+		members, err = membership.NewList(membership.Addrs(shards), membership.Options{
+			Self:           *httpAddr,
+			ProbeInterval:  *gossipEvery,
+			SuspectTimeout: *suspectWait,
+		})
+		if err != nil {
+			log.Fatalf("Invalid membership settings: %v", err)
+		}
+		srv.SetMembership(members)
+		dir.SetHealthCheck(members.Alive)
+	}
+
+	// failover owns the replication client, it points it at whoever leads the shard
+	// our own address doubles as the replica id the leader tracks our position under
+	node, err := failover.NewNode(dbInstance, dir, shards.CurIdx, failover.Options{
+		Self:         *httpAddr,
+		LeaseTimeout: *leaseTimeout,
+		Replication: replication.Options{
+			BatchSize:    *batchSize,
+			LongPollWait: *longPoll,
+		},
+		OnReplicationClient: srv.SetReplicationClient,
+	})
+	if err != nil {
+		log.Fatalf("Invalid failover settings: %v", err)
+	}
+	srv.SetFailover(node)
 
+	if splitParent == "" {
+		if err := node.Start(); err != nil {
+			log.Fatalf("Failed to start failover: %v", err)
+		}
+	} else {
+		c, err := replication.NewClient(dbInstance, splitParent, replication.Options{
+			ReplicaID:    *httpAddr,
+			BatchSize:    *batchSize,
+			LongPollWait: *longPoll,
+		})
+		if err != nil {
+			log.Fatalf("Invalid replication settings: %v", err)
+		}
+		srv.SetReplicationClient(c)
+		// failover only takes over once this node leads its own shard
+		srv.SetSplitParent(splitParent, func() {
+			if err := node.Start(); err != nil {
+				log.Printf("Failed to start failover: %v", err)
+			}
+		})
+		go c.Run()
+	}
+
+	// GET also answers HEAD
+	http.HandleFunc("GET /v1/keys", srv.ScanHandler)
+	http.HandleFunc("GET /v1/keys/{key...}", srv.GetKeyHandler)
+	http.HandleFunc("PUT /v1/keys/{key...}", srv.PutKeyHandler)
+	http.HandleFunc("DELETE /v1/keys/{key...}", srv.DeleteKeyHandler)
+
+	// the original endpoints, kept for existing clients
 	http.HandleFunc("/get", srv.GetHandler)
 	http.HandleFunc("/set", srv.SetHandler)
+	http.HandleFunc("/delete", srv.DeleteHandler)
 	http.HandleFunc("/purge", srv.DeleteExtraKeysHandler)
 	http.HandleFunc("/next-replication-key", srv.GetNextKeyForReplication)
 	http.HandleFunc("/delete-replication-key", srv.DeleteReplicationKey)
+	http.HandleFunc("/replication/snapshot", srv.SnapshotHandler)
+	http.HandleFunc("/replication/status", srv.ReplicationStatusHandler)
+	http.HandleFunc("/replication/positions", srv.ReplicationPositionsHandler)
+	http.HandleFunc("/replication/unregister", srv.UnregisterReplicaHandler)
+	http.HandleFunc("/failover/state", srv.FailoverStateHandler)
+	http.HandleFunc("/reshard/cutover", srv.CutoverHandler)
+	http.HandleFunc("/reshard/promote", srv.PromoteSplitHandler)
+	http.HandleFunc("/admin/reload", srv.ReloadHandler)
+	http.HandleFunc("/cluster/topology", srv.TopologyHandler)
+	http.HandleFunc("/cluster/members", srv.MembersHandler)
+	http.HandleFunc("/cluster/gossip", srv.GossipHandler)
+	http.HandleFunc("/cluster/ping-req", srv.PingReqHandler)
+
+	// the shard layout can change without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := srv.ReloadConfig(); err != nil {
+				log.Printf("Reloading %q on SIGHUP failed: %v", *configFile, err)
+			}
+		}
+	}()
+	if members != nil {
+		go members.Run(context.Background())
+	}
+	if *configPoll > 0 {
+		go srv.WatchConfig(context.Background(), *configPoll)
+	}
+
+	// gRPC on the same address, a message carries at most one value and a bit of framing
+	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(int(*maxValueSize) + 1<<20))
+	srv.RegisterGRPC(grpcServer)
+
+	l, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		log.Fatalf("Listening on %s: %v", *httpAddr, err)
+	}
+	grpcL, httpL := transport.SplitListener(l)
+	go func() {
+		log.Fatal(grpcServer.Serve(grpcL))
+	}()
 
-	log.Printf("Serving on http://%s ...", *httpAddr)
-	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+	log.Printf("Serving HTTP and gRPC on %s ...", *httpAddr)
+	log.Fatal(http.Serve(httpL, nil))
 }
@@ -2,22 +2,38 @@ package config
 
 import (
 	"fmt"
-	"hash/fnv"
+	"reflect"
+	"sort"
 
 	"github.com/BurntSushi/toml"
 )
 
 // the sharding.toml matches thi structure
 // shard describes a shard that holds the appropriate set of keys
+// the json tags are for /cluster/topology, which hands the config out as is
 type Shard struct {
-	Name    string
-	Idx     int
-	Address string
+	Name     string   `json:"name"`
+	Idx      int      `json:"idx"`
+	Address  string   `json:"address"`
+	Replicas []string `json:"replicas,omitempty"` // addresses of the read-only replicas pulling from Address
+	Weight   int      `json:"weight,omitempty"`   // share of the keys relative to the other shards with the consistent-hash partitioner, 0 means 1
+
+	// the keys from Start up to but not including End with the range partitioner, "" is open ended
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// SplitOf names the shard this one takes a range over from, it copies its keys from there until the cut-over
+	SplitOf string `toml:"split_of" json:"split_of,omitempty"`
 }
 
 // all the shards
 type Config struct {
-	Shards []Shard
+	// Epoch versions the topology, every change of the config should bump it.
+	// Nodes compare epochs on forwarded requests and never go back to an older one.
+	Epoch        uint64  `json:"epoch"`
+	Partitioner  string  `json:"partitioner,omitempty"`                        // "modulo" (default), "consistent-hash" or "range"
+	VirtualNodes int     `toml:"virtual_nodes" json:"virtual_nodes,omitempty"` // ring points per unit of shard weight with consistent-hash
+	SplitFrom    int     `toml:"split_from" json:"split_from,omitempty"`       // shard count this config doubles, shards from here on copy their keys from shard idx-SplitFrom
+	Shards       []Shard `json:"shards"`
 }
 
 // all the [[shard]] blocks fill the Shards slice
@@ -30,24 +46,190 @@ func ParseFile(filename string) (Config, error) {
 	return c, nil
 }
 
+// Parse is ParseFile for a config that is already in memory, e.g. pushed to a node.
+func Parse(data []byte) (Config, error) {
+	var c Config
+	if _, err := toml.Decode(string(data), &c); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
 // run time friendly, total number of shards, the current shard, and a map of shard index to address
 type Shards struct {
-	Count  int
-	CurIdx int // which shard this machine is
-	Addrs  map[int]string
+	Count       int
+	CurIdx      int // which shard this machine is
+	Addrs       map[int]string
+	Replicas    map[int][]string // shard index to its replica addresses
+	Partitioner Partitioner      // nil means Modulo
+	SplitFrom   int              // shard count before the modulo split this config describes, 0 if none
+	Parents     map[int]int      // new shard to the shard it copies its keys from during a split
+	Epoch       uint64           // version of the topology
+	Source      Config           // the config this was parsed from
+}
+
+// ParseConfig is ParseShards plus the partitioner chosen in the config.
+func ParseConfig(c Config, curShardName string) (*Shards, error) {
+	shards, err := ParseShards(c.Shards, curShardName)
+	if err != nil {
+		return nil, err
+	}
+	if shards.Partitioner, err = NewPartitioner(c); err != nil {
+		return nil, err
+	}
+
+	if shards.Parents, err = splitParents(c, shards); err != nil {
+		return nil, err
+	}
+	shards.SplitFrom = c.SplitFrom
+	shards.Epoch = c.Epoch
+	shards.Source = c
+	return shards, nil
+}
+
+// ParseLayout is ParseConfig for a process that is none of the shards, like a client, CurIdx is -1.
+func ParseLayout(c Config) (*Shards, error) {
+	if len(c.Shards) == 0 {
+		return nil, fmt.Errorf("the config has no shards")
+	}
+	shards, err := ParseConfig(c, c.Shards[0].Name)
+	if err != nil {
+		return nil, err
+	}
+	shards.CurIdx = -1
+	return shards, nil
+}
+
+// splitParents finds the shards the config adds by a split, either by doubling with split_from
+// or by taking over a range with split_of
+func splitParents(c Config, shards *Shards) (map[int]int, error) {
+	parents := make(map[int]int)
+	if c.SplitFrom != 0 {
+		if c.SplitFrom*2 != shards.Count {
+			return nil, fmt.Errorf("split_from = %d but a split needs exactly %d shards, got %d", c.SplitFrom, c.SplitFrom*2, shards.Count)
+		}
+		if _, ok := shards.Partitioner.(Modulo); !ok {
+			return nil, fmt.Errorf("split_from needs the %s partitioner", PartitionerModulo)
+		}
+		for idx := c.SplitFrom; idx < shards.Count; idx++ {
+			parents[idx] = idx - c.SplitFrom
+		}
+	}
+
+	byName := make(map[string]Shard)
+	for _, s := range c.Shards {
+		byName[s.Name] = s
+	}
+	for _, s := range c.Shards {
+		if s.SplitOf == "" {
+			continue
+		}
+		if _, ok := shards.Partitioner.(*Ranges); !ok {
+			return nil, fmt.Errorf("split_of needs the %s partitioner", PartitionerRange)
+		}
+		parent, ok := byName[s.SplitOf]
+		if !ok || parent.SplitOf != "" {
+			return nil, fmt.Errorf("shard %q is split off %q, which is not an existing shard", s.Name, s.SplitOf)
+		}
+		parents[s.Idx] = parent.Idx
+	}
+	return parents, nil
+}
+
+// SplitParent returns the shard idx copies its keys from during a split,
+// ok is false for shards that existed before it.
+func (s *Shards) SplitParent(idx int) (parent int, ok bool) {
+	parent, ok = s.Parents[idx]
+	return parent, ok
+}
+
+// Children returns the shards split off idx, in index order.
+func (s *Shards) Children(idx int) []int {
+	var res []int
+	for child, parent := range s.Parents {
+		if parent == idx {
+			res = append(res, child)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
+
+// ValidateSplit checks that next only adds shards split off shards of prev, and that
+// every key either stays where it is or moves to a child of its shard.
+// With hash % Count doubling the shards does that, shard i keeps some keys and hands the rest to i+prev.Count.
+// With ranges a shard hands the end of its range to its children.
+func ValidateSplit(prev, next *Shards) error {
+	if len(next.Parents) == 0 || next.Count != prev.Count+len(next.Parents) {
+		return fmt.Errorf("expected %d shards plus the ones split off them, got %d shards of which %d are split off", prev.Count, next.Count, len(next.Parents))
+	}
+	if next.CurIdx != prev.CurIdx {
+		return fmt.Errorf("this node moves from shard %d to %d", prev.CurIdx, next.CurIdx)
+	}
+	for i := 0; i < prev.Count; i++ {
+		if prev.Addrs[i] != next.Addrs[i] {
+			return fmt.Errorf("shard %d moves from %q to %q", i, prev.Addrs[i], next.Addrs[i])
+		}
+		if _, ok := next.Parents[i]; ok {
+			return fmt.Errorf("shard %d exists already, it can't be split off another one", i)
+		}
+	}
+
+	switch p := prev.Partitioner.(type) {
+	case nil, Modulo:
+		if next.SplitFrom != prev.Count {
+			return fmt.Errorf("expected a split of %d shards into %d, got %d shards split from %d", prev.Count, 2*prev.Count, next.Count, next.SplitFrom)
+		}
+	case *Ranges:
+		n, ok := next.Partitioner.(*Ranges)
+		if !ok {
+			return fmt.Errorf("ranges can only be split into ranges")
+		}
+		for i := 0; i < prev.Count; i++ {
+			if err := p.splitInto(n, i, append([]int{i}, next.Children(i)...)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("shards placed by %T can't be split", p)
+	}
+	return nil
 }
 
 func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 	shardCount := len(shards)
 	shardIdx := -1
 	addrs := make(map[int]string)
+	replicas := make(map[int][]string)
+
+	// every address is one node, so it may show up only once, as a leader or as a replica
+	seen := make(map[string]string)
+	claim := func(addr, role string) error {
+		if addr == "" {
+			return fmt.Errorf("empty address for %s", role)
+		}
+		if other, ok := seen[addr]; ok {
+			return fmt.Errorf("address %q used for both %s and %s", addr, other, role)
+		}
+		seen[addr] = role
+		return nil
+	}
 
 	for _, s := range shards {
 		if _, ok := addrs[s.Idx]; ok {
 			return nil, fmt.Errorf("duplicate shard index: %d", s.Idx)
 		}
+		if err := claim(s.Address, fmt.Sprintf("leader of shard %q", s.Name)); err != nil {
+			return nil, err
+		}
+		for _, r := range s.Replicas {
+			if err := claim(r, fmt.Sprintf("replica of shard %q", s.Name)); err != nil {
+				return nil, err
+			}
+		}
 		// map shard index to its address
 		addrs[s.Idx] = s.Address
+		replicas[s.Idx] = s.Replicas
 		if s.Name == curShardName {
 			shardIdx = s.Idx
 		}
@@ -64,15 +246,68 @@ func ParseShards(shards []Shard, curShardName string) (*Shards, error) {
 	}
 
 	return &Shards{
-		Addrs:  addrs,
-		Count:  shardCount,
-		CurIdx: shardIdx,
+		Addrs:    addrs,
+		Count:    shardCount,
+		CurIdx:   shardIdx,
+		Replicas: replicas,
 	}, nil
 }
 
+// Locate finds the node listening on addr, it returns the name of its shard and whether it is one of the replicas.
+func Locate(shards []Shard, addr string) (name string, replica bool, err error) {
+	for _, s := range shards {
+		if s.Address == addr {
+			return s.Name, false, nil
+		}
+		for _, r := range s.Replicas {
+			if r == addr {
+				return s.Name, true, nil
+			}
+		}
+	}
+	return "", false, fmt.Errorf("address %q is neither a leader nor a replica in the config", addr)
+}
+
+// SameOwnership tells whether every key belongs to the same shard under a and b.
+// Addresses and replicas may differ.
+func SameOwnership(a, b *Shards) bool {
+	return a.Count == b.Count && reflect.DeepEqual(a.partitioner(), b.partitioner())
+}
+
+// ValidateEpoch checks that next may follow prev: the epoch never goes back, and a config
+// that moves keys between shards has to come with a new epoch unless epochs are not used at all.
+func ValidateEpoch(prev, next *Shards) error {
+	if next.Epoch < prev.Epoch {
+		return fmt.Errorf("topology epoch %d is older than the current epoch %d", next.Epoch, prev.Epoch)
+	}
+	if next.Epoch == prev.Epoch && next.Epoch != 0 && !SameOwnership(prev, next) {
+		return fmt.Errorf("the config moves keys between shards but keeps topology epoch %d", next.Epoch)
+	}
+	return nil
+}
+
+func (s *Shards) partitioner() Partitioner {
+	if s.Partitioner == nil {
+		return Modulo{Count: s.Count}
+	}
+	return s.Partitioner
+}
+
+// MayHold tells whether shard idx may own keys from start up to but not including end, "" end is open ended.
+// Only the range partitioner rules any shard out.
+func (s *Shards) MayHold(idx int, start, end string) bool {
+	ranges, ok := s.Partitioner.(*Ranges)
+	if !ok {
+		return true
+	}
+	lo, hi, ok := ranges.Range(idx)
+	if !ok {
+		return true
+	}
+	return (end == "" || lo < end) && (hi == "" || start < hi)
+}
+
 // Index, returns the shard number for the corresponding key.
 func (s *Shards) Index(key string) int {
-	h := fnv.New64()
-	h.Write([]byte(key))
-	return int(h.Sum64() % uint64(s.Count))
+	return s.partitioner().Index(key)
 }
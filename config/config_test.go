@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"testing"
 
@@ -19,6 +20,7 @@ address = "127.0.0.2:8080"
 name = "Bangalore"
 idx = 1
 address = "127.0.0.3:8080"
+replicas = ["127.0.0.33:8080", "127.0.0.34:8080"]
 `), 0644)
 	require.NoError(t, err)
 	defer os.Remove(configFile)
@@ -28,6 +30,7 @@ address = "127.0.0.3:8080"
 	require.Len(t, conf.Shards, 2)
 	require.Equal(t, "Hyderabad", conf.Shards[0].Name)
 	require.Equal(t, 1, conf.Shards[1].Idx)
+	require.Equal(t, []string{"127.0.0.33:8080", "127.0.0.34:8080"}, conf.Shards[1].Replicas)
 }
 
 func TestParseShards_ValidConfig(t *testing.T) {
@@ -73,6 +76,48 @@ func TestParseShards_UnknownCurrentNode(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestParseShards_Replicas(t *testing.T) {
+	shards := []Shard{
+		{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080", Replicas: []string{"127.0.0.22:8080", "127.0.0.23:8080"}},
+		{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080", Replicas: []string{"127.0.0.33:8080"}},
+	}
+
+	parsed, err := ParseShards(shards, "Bangalore")
+	require.NoError(t, err)
+	require.Equal(t, []string{"127.0.0.22:8080", "127.0.0.23:8080"}, parsed.Replicas[0])
+	require.Equal(t, []string{"127.0.0.33:8080"}, parsed.Replicas[1])
+
+	name, replica, err := Locate(shards, "127.0.0.23:8080")
+	require.NoError(t, err)
+	require.Equal(t, "Hyderabad", name)
+	require.True(t, replica)
+
+	name, replica, err = Locate(shards, "127.0.0.3:8080")
+	require.NoError(t, err)
+	require.Equal(t, "Bangalore", name)
+	require.False(t, replica)
+
+	_, _, err = Locate(shards, "127.0.0.99:8080")
+	require.Error(t, err)
+}
+
+func TestParseShards_InvalidReplicas(t *testing.T) {
+	for name, replicas := range map[string][]string{
+		"duplicate":           {"127.0.0.22:8080", "127.0.0.22:8080"},
+		"own leader":          {"127.0.0.2:8080"},
+		"other shard leader":  {"127.0.0.3:8080"},
+		"other shard replica": {"127.0.0.33:8080"},
+		"empty":               {""},
+	} {
+		shards := []Shard{
+			{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080", Replicas: replicas},
+			{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080", Replicas: []string{"127.0.0.33:8080"}},
+		}
+		_, err := ParseShards(shards, "Hyderabad")
+		require.Error(t, err, name)
+	}
+}
+
 func TestShards_Index(t *testing.T) {
 	s := &Shards{
 		Count:  3,
@@ -90,3 +135,249 @@ func TestShards_Index(t *testing.T) {
 		require.True(t, idx >= 0 && idx < s.Count, "shard index out of bounds for key: %s", k)
 	}
 }
+
+func TestParseConfig_Partitioner(t *testing.T) {
+	configFile := "test_partitioner.toml"
+	err := os.WriteFile(configFile, []byte(`
+partitioner = "consistent-hash"
+virtual_nodes = 64
+
+[[shards]]
+name = "Hyderabad"
+idx = 0
+address = "127.0.0.2:8080"
+
+[[shards]]
+name = "Bangalore"
+idx = 1
+address = "127.0.0.3:8080"
+weight = 2
+`), 0644)
+	require.NoError(t, err)
+	defer os.Remove(configFile)
+
+	conf, err := ParseFile(configFile)
+	require.NoError(t, err)
+	require.Equal(t, 64, conf.VirtualNodes)
+	require.Equal(t, 2, conf.Shards[1].Weight)
+
+	shards, err := ParseConfig(conf, "Hyderabad")
+	require.NoError(t, err)
+	require.IsType(t, &HashRing{}, shards.Partitioner)
+
+	conf.Partitioner = "random"
+	_, err = ParseConfig(conf, "Hyderabad")
+	require.Error(t, err)
+
+	conf.Partitioner = ""
+	shards, err = ParseConfig(conf, "Hyderabad")
+	require.NoError(t, err)
+	require.Equal(t, Modulo{Count: 2}, shards.Partitioner)
+}
+
+func TestHashRing_Rebalance(t *testing.T) {
+	names := []string{"Hyderabad", "Bangalore", "Mumbai", "Delhi", "Chennai"}
+	var shards []Shard
+	for i, name := range names {
+		shards = append(shards, Shard{Name: name, Idx: i})
+	}
+
+	before, err := NewHashRing(shards[:4], 0)
+	require.NoError(t, err)
+	after, err := NewHashRing(shards, 0)
+	require.NoError(t, err)
+
+	const keys = 10000
+	moved, modMoved := 0, 0
+	counts := make(map[int]int)
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if a := after.Index(key); a != before.Index(key) {
+			// a key only ever moves to the new shard
+			require.Equal(t, 4, a)
+			moved++
+		}
+		if (Modulo{Count: 4}).Index(key) != (Modulo{Count: 5}).Index(key) {
+			modMoved++
+		}
+		counts[before.Index(key)]++
+	}
+
+	// the new shard takes about a fifth of the keys, modulo moves about four fifths
+	require.InDelta(t, keys/5, moved, keys/10)
+	require.Greater(t, modMoved, keys/2)
+	for idx := 0; idx < 4; idx++ {
+		require.InDelta(t, keys/4, counts[idx], keys/10, "shard %d", idx)
+	}
+}
+
+func TestHashRing_Weights(t *testing.T) {
+	ring, err := NewHashRing([]Shard{
+		{Name: "Hyderabad", Idx: 0},
+		{Name: "Bangalore", Idx: 1, Weight: 3},
+	}, 0)
+	require.NoError(t, err)
+
+	counts := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		counts[ring.Index(fmt.Sprintf("key-%d", i))]++
+	}
+	require.InDelta(t, 7500, counts[1], 1000)
+
+	_, err = NewHashRing([]Shard{{Name: "Hyderabad", Idx: 0, Weight: -1}}, 0)
+	require.Error(t, err)
+}
+
+func TestParseConfig_Split(t *testing.T) {
+	prev, err := ParseConfig(Config{Shards: []Shard{
+		{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080"},
+		{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080"},
+	}}, "Bangalore")
+	require.NoError(t, err)
+
+	split := Config{SplitFrom: 2, Shards: []Shard{
+		{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080"},
+		{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080"},
+		{Name: "Mumbai", Idx: 2, Address: "127.0.0.4:8080"},
+		{Name: "Delhi", Idx: 3, Address: "127.0.0.5:8080"},
+	}}
+	next, err := ParseConfig(split, "Bangalore")
+	require.NoError(t, err)
+	require.NoError(t, ValidateSplit(prev, next))
+
+	_, ok := next.SplitParent(1)
+	require.False(t, ok)
+	parent, ok := next.SplitParent(3)
+	require.True(t, ok)
+	require.Equal(t, 1, parent)
+
+	// every key stays on its shard or moves to that shard's child
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		require.Equal(t, prev.Index(key), next.Index(key)%2)
+	}
+
+	// a node may not change shards in a split
+	other, err := ParseConfig(split, "Hyderabad")
+	require.NoError(t, err)
+	require.Error(t, ValidateSplit(prev, other))
+
+	// neither may a shard move
+	split.Shards[0].Address = "127.0.0.9:8080"
+	moved, err := ParseConfig(split, "Bangalore")
+	require.NoError(t, err)
+	require.Error(t, ValidateSplit(prev, moved))
+
+	split.Shards = split.Shards[:3]
+	_, err = ParseConfig(split, "Bangalore")
+	require.Error(t, err)
+}
+
+func TestRanges(t *testing.T) {
+	shards := []Shard{
+		{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080", End: "g"},
+		{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080", Start: "g", End: "p"},
+		{Name: "Mumbai", Idx: 2, Address: "127.0.0.4:8080", Start: "p"},
+	}
+	parsed, err := ParseConfig(Config{Partitioner: PartitionerRange, Shards: shards}, "Mumbai")
+	require.NoError(t, err)
+
+	for key, idx := range map[string]int{"": 0, "apple": 0, "fzz": 0, "g": 1, "grape": 1, "oz": 1, "p": 2, "pear": 2, "zebra": 2} {
+		require.Equal(t, idx, parsed.Index(key), key)
+	}
+
+	for name, bad := range map[string][]Shard{
+		"gap":        {{Idx: 0, End: "g"}, {Idx: 1, Start: "h"}},
+		"overlap":    {{Idx: 0, End: "h"}, {Idx: 1, Start: "g"}},
+		"no start":   {{Idx: 0, Start: "a", End: "g"}, {Idx: 1, Start: "g"}},
+		"no end":     {{Idx: 0, End: "g"}, {Idx: 1, Start: "g", End: "z"}},
+		"two opens":  {{Idx: 0}, {Idx: 1}},
+		"empty":      {{Idx: 0, End: "g"}, {Idx: 1, Start: "g", End: "g"}, {Idx: 2, Start: "g"}},
+		"open start": {{Idx: 0}, {Idx: 1, Start: "g"}},
+	} {
+		_, err := NewRanges(bad)
+		require.Error(t, err, name)
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	c := Config{Partitioner: PartitionerRange, Shards: []Shard{
+		{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080", End: "m"},
+		{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080", Start: "m"},
+	}}
+	prev, err := ParseConfig(c, "Bangalore")
+	require.NoError(t, err)
+
+	split, err := SplitRange(c, "Bangalore", "t", Shard{Name: "Mumbai", Address: "127.0.0.4:8080"})
+	require.NoError(t, err)
+	require.Equal(t, "m", c.Shards[1].Start)
+	require.Equal(t, "", c.Shards[1].End, "the original config is left alone")
+
+	next, err := ParseConfig(split, "Bangalore")
+	require.NoError(t, err)
+	require.NoError(t, ValidateSplit(prev, next))
+	require.Equal(t, []int{2}, next.Children(1))
+	require.Equal(t, 1, next.Index("pear"))
+	require.Equal(t, 2, next.Index("tomato"))
+
+	_, err = SplitRange(c, "Bangalore", "a", Shard{Name: "Mumbai", Address: "127.0.0.4:8080"})
+	require.Error(t, err, "outside the range")
+	_, err = SplitRange(c, "Chennai", "t", Shard{Name: "Mumbai", Address: "127.0.0.4:8080"})
+	require.Error(t, err)
+
+	// a split has to hand over exactly the end of the parent's range
+	split.Shards[2].Start = "u"
+	split.Shards[1].End = "u"
+	split.Shards[0].End = "n"
+	split.Shards[1].Start = "n"
+	bad, err := ParseConfig(split, "Bangalore")
+	require.NoError(t, err)
+	require.Error(t, ValidateSplit(prev, bad))
+}
+
+func TestValidateEpoch(t *testing.T) {
+	c := Config{Epoch: 3, Shards: []Shard{
+		{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080"},
+		{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080"},
+	}}
+	prev, err := ParseConfig(c, "Hyderabad")
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), prev.Epoch)
+
+	// same layout, same epoch, e.g. the file was touched
+	require.NoError(t, ValidateEpoch(prev, prev))
+
+	c.Epoch = 2
+	older, err := ParseConfig(c, "Hyderabad")
+	require.NoError(t, err)
+	require.Error(t, ValidateEpoch(prev, older))
+
+	c.Epoch = 3
+	c.Partitioner = PartitionerConsistentHash
+	moved, err := ParseConfig(c, "Hyderabad")
+	require.NoError(t, err)
+	require.Error(t, ValidateEpoch(prev, moved), "keys move without a new epoch")
+
+	c.Epoch = 4
+	moved, err = ParseConfig(c, "Hyderabad")
+	require.NoError(t, err)
+	require.NoError(t, ValidateEpoch(prev, moved))
+}
+
+func TestParseLayout(t *testing.T) {
+	c := Config{Epoch: 2, Partitioner: PartitionerRange, Shards: []Shard{
+		{Name: "Hyderabad", Idx: 0, Address: "127.0.0.2:8080", End: "n"},
+		{Name: "Bangalore", Idx: 1, Address: "127.0.0.3:8080", Start: "n"},
+	}}
+	shards, err := ParseLayout(c)
+	require.NoError(t, err)
+	require.Equal(t, -1, shards.CurIdx)
+	require.Equal(t, uint64(2), shards.Epoch)
+	require.Equal(t, 1, shards.Index("zebra"))
+	require.False(t, shards.MayHold(1, "a", "c"))
+	require.True(t, shards.MayHold(1, "a", ""))
+	require.False(t, shards.MayHold(0, "p", ""))
+
+	_, err = ParseLayout(Config{})
+	require.Error(t, err)
+}
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// a partitioner decides which shard owns a key
+// modulo is the original fnv64(key) % Count, simple but adding a shard moves almost every key
+// consistent-hash puts every shard on a ring many times over (virtual nodes) and a key belongs to
+// the first shard point at or after the key's hash, so a new shard only takes over a slice of the ring
+// range gives every shard a contiguous range of keys, so a range scan only touches the shards owning it
+
+// partitioner names for the partitioner key in sharding.toml
+const (
+	PartitionerModulo         = "modulo"
+	PartitionerConsistentHash = "consistent-hash"
+	PartitionerRange          = "range"
+)
+
+// DefaultVirtualNodes is how many ring points a shard of weight 1 gets when virtual_nodes is not set
+const DefaultVirtualNodes = 128
+
+// Partitioner maps a key to the index of the shard owning it.
+type Partitioner interface {
+	Index(key string) int
+}
+
+// NewPartitioner builds the partitioner named in the config.
+func NewPartitioner(c Config) (Partitioner, error) {
+	switch c.Partitioner {
+	case "", PartitionerModulo:
+		return Modulo{Count: len(c.Shards)}, nil
+	case PartitionerConsistentHash:
+		return NewHashRing(c.Shards, c.VirtualNodes)
+	case PartitionerRange:
+		return NewRanges(c.Shards)
+	}
+	return nil, fmt.Errorf("unknown partitioner %q, expected %q, %q or %q", c.Partitioner, PartitionerModulo, PartitionerConsistentHash, PartitionerRange)
+}
+
+// Modulo is the fnv64(key) % Count partitioner.
+type Modulo struct {
+	Count int
+}
+
+func (m Modulo) Index(key string) int {
+	h := fnv.New64()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(m.Count))
+}
+
+// HashRing is a consistent-hash ring, a shard of weight w gets w*virtualNodes points on it.
+type HashRing struct {
+	points []uint64 // sorted
+	owners []int    // owners[i] is the shard index of points[i]
+}
+
+// NewHashRing places the shards on a ring, 0 virtual nodes means DefaultVirtualNodes.
+// Points are derived from shard names, so renumbering shards does not move keys.
+func NewHashRing(shards []Shard, virtualNodes int) (*HashRing, error) {
+	if virtualNodes < 0 {
+		return nil, fmt.Errorf("virtual_nodes must not be negative, got %d", virtualNodes)
+	}
+	if virtualNodes == 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards to place on the ring")
+	}
+
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	var points []point
+	for _, s := range shards {
+		if s.Weight < 0 {
+			return nil, fmt.Errorf("shard %q has negative weight %d", s.Name, s.Weight)
+		}
+		weight := s.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		for i := 0; i < weight*virtualNodes; i++ {
+			points = append(points, point{hash: ringHash(s.Name + "#" + strconv.Itoa(i)), owner: s.Idx})
+		}
+	}
+
+	// ties are next to impossible, but break them the same way on every node
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	r := &HashRing{points: make([]uint64, len(points)), owners: make([]int, len(points))}
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.owners[i] = p.owner
+	}
+	return r, nil
+}
+
+func (r *HashRing) Index(key string) int {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0 // wrap around
+	}
+	return r.owners[i]
+}
+
+// ringHash is fnv64a with a final mix, plain fnv leaves strings that only differ
+// in their last byte close together, which clusters the virtual nodes of a shard
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Ranges gives every shard the keys from its Start up to but not including its End.
+type Ranges struct {
+	ranges []keyRange // sorted by start
+}
+
+type keyRange struct {
+	start, end string // "" is open ended
+	idx        int
+}
+
+// NewRanges checks that the shard ranges cover every key exactly once, i.e. sorted by start the first
+// one starts at "", every range ends where the next one starts and the last one ends at "".
+func NewRanges(shards []Shard) (*Ranges, error) {
+	r := &Ranges{}
+	for _, s := range shards {
+		r.ranges = append(r.ranges, keyRange{start: s.Start, end: s.End, idx: s.Idx})
+	}
+	sort.Slice(r.ranges, func(i, j int) bool { return r.ranges[i].start < r.ranges[j].start })
+
+	if len(r.ranges) == 0 {
+		return nil, fmt.Errorf("no shards to give ranges to")
+	}
+	if first := r.ranges[0]; first.start != "" {
+		return nil, fmt.Errorf("keys before %q belong to no shard", first.start)
+	}
+	for i, kr := range r.ranges {
+		if kr.end != "" && kr.end <= kr.start {
+			return nil, fmt.Errorf("shard %d has the empty range [%q, %q)", kr.idx, kr.start, kr.end)
+		}
+		if i == len(r.ranges)-1 {
+			if kr.end != "" {
+				return nil, fmt.Errorf("keys from %q on belong to no shard", kr.end)
+			}
+			break
+		}
+		next := r.ranges[i+1]
+		switch {
+		case kr.end == "" || kr.end > next.start:
+			return nil, fmt.Errorf("shards %d and %d overlap from %q", kr.idx, next.idx, next.start)
+		case kr.end < next.start:
+			return nil, fmt.Errorf("keys from %q to %q belong to no shard", kr.end, next.start)
+		}
+	}
+	return r, nil
+}
+
+func (r *Ranges) Index(key string) int {
+	// the last range starting at or before the key, the first one starts at "" so there always is one
+	i := sort.Search(len(r.ranges), func(i int) bool { return r.ranges[i].start > key })
+	return r.ranges[i-1].idx
+}
+
+// Range returns the keys shard idx owns, from start up to but not including end.
+func (r *Ranges) Range(idx int) (start, end string, ok bool) {
+	for _, kr := range r.ranges {
+		if kr.idx == idx {
+			return kr.start, kr.end, true
+		}
+	}
+	return "", "", false
+}
+
+// splitInto checks that the ranges of shards in next together are exactly the range of idx in r
+func (r *Ranges) splitInto(next *Ranges, idx int, shards []int) error {
+	start, end, _ := r.Range(idx)
+
+	var parts []keyRange
+	for _, s := range shards {
+		from, to, _ := next.Range(s)
+		parts = append(parts, keyRange{start: from, end: to, idx: s})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].start < parts[j].start })
+
+	at := start
+	for _, p := range parts {
+		if p.start != at {
+			return fmt.Errorf("shard %d owned [%q, %q) but its split starts shard %d at %q", idx, start, end, p.idx, p.start)
+		}
+		at = p.end
+	}
+	if at != end {
+		return fmt.Errorf("shard %d owned [%q, %q) but its split ends at %q", idx, start, end, at)
+	}
+	return nil
+}
+
+// SplitRange returns a copy of c in which child takes over the keys of shard name from at on.
+// child becomes the last shard and copies its keys from the shard it is split off until the cut-over.
+func SplitRange(c Config, name, at string, child Shard) (Config, error) {
+	if c.Partitioner != PartitionerRange {
+		return Config{}, fmt.Errorf("only the %s partitioner has ranges to split", PartitionerRange)
+	}
+
+	shards := append([]Shard(nil), c.Shards...)
+	found := false
+	for i, s := range shards {
+		if s.Name != name {
+			continue
+		}
+		if at <= s.Start || (s.End != "" && at >= s.End) {
+			return Config{}, fmt.Errorf("%q is not inside the range [%q, %q) of shard %q", at, s.Start, s.End, name)
+		}
+		child.Idx = len(shards)
+		child.Start, child.End = at, s.End
+		child.SplitOf = name
+		shards[i].End = at
+		found = true
+	}
+	if !found {
+		return Config{}, fmt.Errorf("shard %q was not found", name)
+	}
+
+	c.Shards = append(shards, child)
+	if _, err := NewRanges(c.Shards); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
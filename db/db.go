@@ -4,16 +4,36 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	bolt "go.etcd.io/bbolt"
 )
 
 var defaultBucket = []byte("default")
 var replicaBucket = []byte("replication")
+var replicaStateBucket = []byte("replication-state")
+var replicaAcksBucket = []byte("replication-acks")
+
+// ErrReadOnly is returned by writes on a node that does not lead its shard.
+var ErrReadOnly = errors.New("read-only mode")
+
+// ErrNotFound is returned by GetKey for a key that was never set or got deleted.
+// A key set to an empty value is found, with an empty value.
+var ErrNotFound = errors.New("key not found")
+
+// ErrConditionFailed is returned by SetKeyIf and DeleteKeyIf when the key's current value does not pass the check.
+var ErrConditionFailed = errors.New("condition failed")
 
 type Database struct {
 	db       *bolt.DB
-	readOnly bool
+	readOnly atomic.Bool // flipped by failover, so it has to be safe to read while writes come in
+
+	mu          sync.Mutex
+	logChanged  chan struct{}  // closed and replaced every time the replication log grows
+	acksChanged chan struct{}  // closed and replaced every time a replica acks
+	holds       map[int]uint64 // positions of log readers that are not replicas, see HoldLog
+	nextHold    int
 }
 
 // make a new database constructor
@@ -29,7 +49,8 @@ func NewDatabase(dbPath string, readOnly bool) (db *Database, closeFunc func() e
 		return nil, nil, err
 	}
 
-	db = &Database{db: boltDb, readOnly: readOnly}
+	db = &Database{db: boltDb, logChanged: make(chan struct{}), acksChanged: make(chan struct{}), holds: make(map[int]uint64)}
+	db.readOnly.Store(readOnly)
 	closeFunc = boltDb.Close
 
 	if err := db.createBuckets(); err != nil {
@@ -51,27 +72,102 @@ func (d *Database) createBuckets() error {
 		if _, err := tx.CreateBucketIfNotExists(replicaBucket); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists(replicaStateBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(replicaAcksBucket); err != nil {
+			return err
+		}
 		return nil // success, commit the transaction
 	})
 }
 
+// ReadOnly tells whether the database refuses writes, i.e. whether this node is a replica.
+func (d *Database) ReadOnly() bool {
+	return d.readOnly.Load()
+}
+
+// SetReadOnly makes the database refuse or accept writes, failover goes through Promote and Demote instead.
+func (d *Database) SetReadOnly(readOnly bool) {
+	d.readOnly.Store(readOnly)
+}
+
 // SetKey sets the key to the requested value into the default database or returns an error.
 // []byte(key) creates a new byte slice with the same underlying content
 // string is immutable, []byte is mutable
 // you copy over the values
 
 func (d *Database) SetKey(key string, value []byte) error {
-	if d.readOnly {
-		return errors.New("read-only mode")
+	_, err := d.SetKeyWithSeq(key, value)
+	return err
+}
+
+// SetKeyWithSeq is SetKey that also returns the replication log position of the write,
+// so the caller can wait for replicas to acknowledge it.
+func (d *Database) SetKeyWithSeq(key string, value []byte) (uint64, error) {
+	return d.write(LogEntry{Key: key, Value: value})
+}
+
+// SetKeyIf is SetKeyWithSeq that only writes if cond holds for the current value, nil if the key is missing.
+// The check and the write happen in one transaction.
+func (d *Database) SetKeyIf(key string, value []byte, cond func(cur []byte) bool) (uint64, error) {
+	return d.writeIf(LogEntry{Key: key, Value: value}, cond)
+}
+
+// DeleteKey removes the key from the default database and leaves a tombstone
+// in the replication log so the replicas drop it too.
+func (d *Database) DeleteKey(key string) error {
+	_, err := d.DeleteKeyWithSeq(key)
+	return err
+}
+
+// DeleteKeyWithSeq is DeleteKey that also returns the replication log position of the tombstone.
+func (d *Database) DeleteKeyWithSeq(key string) (uint64, error) {
+	return d.write(LogEntry{Key: key, Deleted: true})
+}
+
+// DeleteKeyIf is DeleteKeyWithSeq that only deletes if cond holds for the current value, nil if the key is missing.
+func (d *Database) DeleteKeyIf(key string, cond func(cur []byte) bool) (uint64, error) {
+	return d.writeIf(LogEntry{Key: key, Deleted: true}, cond)
+}
+
+func (d *Database) write(e LogEntry) (seq uint64, err error) {
+	return d.writeIf(e, nil)
+}
+
+// writeIf applies e to the default bucket and appends it to the replication log in one transaction,
+// if cond is nil or holds for the current value
+func (d *Database) writeIf(e LogEntry, cond func(cur []byte) bool) (seq uint64, err error) {
+	if d.readOnly.Load() {
+		return 0, ErrReadOnly
 	}
 
-	return d.db.Update(func(tx *bolt.Tx) error {
-		if err := tx.Bucket(defaultBucket).Put([]byte(key), value); err != nil {
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(defaultBucket)
+		if cond != nil && !cond(b.Get([]byte(e.Key))) {
+			return ErrConditionFailed
+		}
+		var err error
+		if e.Deleted {
+			err = b.Delete([]byte(e.Key))
+		} else {
+			err = b.Put([]byte(e.Key), e.Value)
+		}
+		if err != nil {
 			return err
 		}
 
-		return tx.Bucket(replicaBucket).Put([]byte(key), value)
+		if seq, err = appendToLog(tx, e); err != nil {
+			return err
+		}
+		return d.trimLog(tx)
 	})
+	if err != nil {
+		return 0, err
+	}
+
+	d.notifyLogChanged()
+	return seq, nil
 }
 
 // Even after data is written to the database, it's not considered fully processed until it's delivered (replicated) — so you queue it for delivery first.
@@ -85,6 +181,15 @@ func (d *Database) SetKeyOnReplica(key string, value []byte) error {
 	})
 }
 
+// DeleteKeyOnReplica removes the key from the default database and does not write
+// to the replication queue.
+// This method is intended to be used only on replicas.
+func (d *Database) DeleteKeyOnReplica(key string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(defaultBucket).Delete([]byte(key))
+	})
+}
+
 // defensive copying of slices
 // in go, slices are references
 // a := []byte("hello"); b:=a; shared memory
@@ -98,48 +203,17 @@ func copyByteSlice(b []byte) []byte {
 	return res
 }
 
-func (d *Database) GetNextKeyForReplication() (key, value []byte, err error) {
-	err = d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
-		k, v := b.Cursor().First()
-		key = copyByteSlice(k)
-		value = copyByteSlice(v)
-		return nil
-	})
-
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return key, value, nil
-}
-
-// DeleteReplicationKey deletes the key from the replication queue
-// if the value matches the contents or if the key is already absent.
-// buckets are just nodes in the B+ tree, buckets are transaction scoped views of the data
-func (d *Database) DeleteReplicationKey(key, value []byte) (err error) {
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(replicaBucket)
-
-		v := b.Get(key)
-		if v == nil {
-			return errors.New("key does not exist")
-		}
-
-		if !bytes.Equal(v, value) {
-			return errors.New("value does not match")
-		}
-
-		return b.Delete(key)
-	})
-}
-
-// GetKey get the value of the requested from a default database.
+// GetKey get the value of the requested from a default database, ErrNotFound if it is not there.
 func (d *Database) GetKey(key string) ([]byte, error) {
 	var result []byte
 	err := d.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(defaultBucket)
-		result = copyByteSlice(b.Get([]byte(key)))
+		// bolt returns nil only for a missing key, an empty value comes back empty
+		v := b.Get([]byte(key))
+		if v == nil {
+			return ErrNotFound
+		}
+		result = copyByteSlice(v)
 		return nil
 	})
 
@@ -149,38 +223,91 @@ func (d *Database) GetKey(key string) ([]byte, error) {
 	return nil, err
 }
 
-// DeleteExtraKeys deletes the keys that do not belong to this shard.
-// isExtra - predicate function - tells you if it belongs to a differnt shard
-// View is read only and non blocking
-// now there is a problem, view and update are not in the same transaction
-// handle later
-func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
-	var keys []string
+// KeyValue is a key and its value as Scan returns them.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
 
-	// read only phase collect the keys
+// Scan returns up to limit keys with their values in key order, from start up to but not including end.
+// An empty end is open ended, a limit <= 0 means no limit. keep picks the keys to return, nil keeps all.
+func (d *Database) Scan(start, end string, limit int, keep func(key string) bool) ([]KeyValue, error) {
+	var res []KeyValue
 	err := d.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
-		return b.ForEach(func(k, v []byte) error {
-			ks := string(k)
-			if isExtra(ks) {
-				keys = append(keys, ks)
+		c := tx.Bucket(defaultBucket).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if end != "" && string(k) >= end {
+				break
 			}
-			return nil
-		})
+			if keep != nil && !keep(string(k)) {
+				continue
+			}
+			res = append(res, KeyValue{Key: string(k), Value: copyByteSlice(v)})
+			if limit > 0 && len(res) == limit {
+				break
+			}
+		}
+		return nil
 	})
+	return res, err
+}
 
-	if err != nil {
-		return err
+// extraKeysBatch is how many keys DeleteExtraKeys removes in one transaction
+var extraKeysBatch = 1000
+
+// DeleteExtraKeys deletes the keys that do not belong to this shard.
+// isExtra - predicate function - tells you if it belongs to a differnt shard
+// every delete goes through the replication log like any other, so the replicas drop the keys too,
+// a batch at a time so writes are not held up for the whole bucket
+func (d *Database) DeleteExtraKeys(isExtra func(string) bool) error {
+	if d.readOnly.Load() {
+		return ErrReadOnly
 	}
 
-	return d.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(defaultBucket)
+	var after []byte
+	for {
+		var n int
+		err := d.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(defaultBucket)
+
+			// deleting while iterating confuses the cursor, collect first
+			var keys [][]byte
+			c := b.Cursor()
+			k, _ := c.First()
+			if after != nil {
+				k, _ = c.Seek(after)
+				if bytes.Equal(k, after) {
+					k, _ = c.Next()
+				}
+			}
+			for ; k != nil && len(keys) < extraKeysBatch; k, _ = c.Next() {
+				if isExtra(string(k)) {
+					keys = append(keys, copyByteSlice(k))
+				}
+			}
 
-		for _, k := range keys {
-			if err := b.Delete([]byte(k)); err != nil {
-				return err
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				if _, err := appendToLog(tx, LogEntry{Key: string(k), Deleted: true}); err != nil {
+					return err
+				}
+			}
+			n = len(keys)
+			if n > 0 {
+				after = keys[n-1]
 			}
+			return d.trimLog(tx)
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
+		if n > 0 {
+			d.notifyLogChanged()
+		}
+		if n < extraKeysBatch {
+			return nil
+		}
+	}
 }
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"os"
 	"testing"
 
@@ -20,6 +21,16 @@ func setupTestDB(t *testing.T) (*Database, func()) {
 }
 
 // require will require it to not have errors, code wont continue running
+// nextEntry returns the first log entry after the given position, nil if there is none
+func nextEntry(t *testing.T, db *Database, after uint64) (*LogEntry, error) {
+	t.Helper()
+	entries, err := db.GetReplicationBatch(after, 1)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[0], nil
+}
+
 func TestSetGetKey(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -30,6 +41,16 @@ func TestSetGetKey(t *testing.T) {
 	val, err := db.GetKey("hello")
 	require.NoError(t, err)
 	require.Equal(t, []byte("world"), val)
+
+	// an empty value is not the same as no value
+	require.NoError(t, db.SetKey("empty", nil))
+	val, err = db.GetKey("empty")
+	require.NoError(t, err)
+	require.NotNil(t, val)
+	require.Empty(t, val)
+
+	_, err = db.GetKey("never-set")
+	require.ErrorIs(t, err, ErrNotFound)
 }
 
 // t *testing.T is test runners handle
@@ -44,21 +65,372 @@ func TestReplicationQueue(t *testing.T) {
 	err := db.SetKey(key, value)
 	require.NoError(t, err)
 
-	// Check replication queue
-	k, v, err := db.GetNextKeyForReplication()
+	// Check replication log
+	e, err := nextEntry(t, db, 0)
 	require.NoError(t, err)
-	require.Equal(t, key, string(k))
-	require.Equal(t, value, v)
+	require.NotNil(t, e)
+	require.Equal(t, uint64(1), e.Seq)
+	require.Equal(t, key, e.Key)
+	require.Equal(t, value, e.Value)
+	require.False(t, e.Deleted)
 
-	// Delete from replication queue
-	err = db.DeleteReplicationKey(k, v)
+	// Ack the entry
+	err = db.DeleteReplicationKey("replica-1", e.Seq)
 	require.NoError(t, err)
 
 	// Now it should be gone
-	k, v, err = db.GetNextKeyForReplication()
+	e, err = nextEntry(t, db, 0)
+	require.NoError(t, err)
+	require.Nil(t, e)
+
+	// acking something that was never written is a bug on the replica
+	require.Error(t, db.DeleteReplicationKey("replica-1", 2))
+}
+
+func TestReplicationLogOrder(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// same key twice and keys out of lexical order, nothing may collapse or reorder
+	require.NoError(t, db.SetKey("b", []byte("1")))
+	require.NoError(t, db.SetKey("a", []byte("2")))
+	require.NoError(t, db.SetKey("b", []byte("3")))
+	require.NoError(t, db.DeleteKey("a"))
+
+	var got []LogEntry
+	var after uint64
+	for {
+		e, err := nextEntry(t, db, after)
+		require.NoError(t, err)
+		if e == nil {
+			break
+		}
+		got = append(got, *e)
+		after = e.Seq
+	}
+
+	require.Equal(t, []LogEntry{
+		{Seq: 1, Key: "b", Value: []byte("1")},
+		{Seq: 2, Key: "a", Value: []byte("2")},
+		{Seq: 3, Key: "b", Value: []byte("3")},
+		{Seq: 4, Key: "a", Deleted: true},
+	}, got)
+
+	// acking a position drops everything up to it
+	require.NoError(t, db.DeleteReplicationKey("replica-1", 2))
+	e, err := nextEntry(t, db, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), e.Seq)
+}
+
+func TestReplicationPerReplicaAcks(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	require.NoError(t, db.RegisterReplica("r1", 0))
+	require.NoError(t, db.RegisterReplica("r2", 0))
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, db.SetKey(k, []byte(k)))
+	}
+
+	// the first replica acking everything must not hide the entries from the second one
+	require.NoError(t, db.DeleteReplicationKey("r1", 3))
+	e, err := nextEntry(t, db, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), e.Seq)
+
+	require.NoError(t, db.DeleteReplicationKey("r2", 2))
+	e, err = nextEntry(t, db, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), e.Seq)
+
+	// acks never move backwards
+	require.NoError(t, db.DeleteReplicationKey("r1", 1))
+	// registering again keeps the old position
+	require.NoError(t, db.RegisterReplica("r2", 0))
+
+	positions, err := db.ReplicaPositions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"r1": 3, "r2": 2}, positions)
+
+	// forgetting the slow replica releases what it was holding back
+	require.NoError(t, db.UnregisterReplica("r2"))
+	e, err = nextEntry(t, db, 0)
+	require.NoError(t, err)
+	require.Nil(t, e)
+
+	// and a replica that never registered can't catch up from the log anymore
+	require.ErrorIs(t, db.CheckReplicationPosition(0), ErrSnapshotRequired)
+	require.NoError(t, db.CheckReplicationPosition(3))
+}
+
+func TestRegisterReplicaPosition(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, db.SetKey(k, []byte(k)))
+	}
+
+	// a replica ahead of the log, say an old leader after a failover, is not taken at its word
+	require.ErrorIs(t, db.RegisterReplica("r1", 10), ErrSnapshotRequired)
+	n, err := db.AckedBy(3, []string{"r1"})
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// a snapshot moves a known replica wherever it is
+	require.NoError(t, db.RegisterReplica("r1", 1))
+	require.NoError(t, db.ResetReplica("r1", 3))
+	require.ErrorIs(t, db.ResetReplica("r1", 4), ErrUnknownSeq)
+	positions, err := db.ReplicaPositions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"r1": 3}, positions)
+}
+
+func TestHoldLog(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	require.NoError(t, db.RegisterReplica("r1", 0))
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, db.SetKey(k, []byte(k)))
+	}
+
+	// a reader at 1 keeps what comes after it, whatever the replica acked
+	move, release := db.HoldLog(1)
+	require.NoError(t, db.DeleteReplicationKey("r1", 3))
+	entries, err := db.GetReplicationBatch(1, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NoError(t, db.CheckReplicationPosition(1))
+
+	// the next trim drops what it moved past
+	move(2)
+	require.NoError(t, db.SetKey("d", []byte("d")))
+	require.NoError(t, db.DeleteReplicationKey("r1", 4))
+	entries, err = db.GetReplicationBatch(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, uint64(3), entries[0].Seq)
+
+	// and everything once it is released
+	release()
+	require.NoError(t, db.SetKey("e", []byte("e")))
+	require.NoError(t, db.DeleteReplicationKey("r1", 5))
+	entries, err = db.GetReplicationBatch(0, 10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.ErrorIs(t, db.CheckReplicationPosition(2), ErrSnapshotRequired)
+}
+
+func TestLogRetention(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer func(n uint64) { logRetention = n }(logRetention)
+	logRetention = 3
+
+	// with no replica the log keeps its last few entries only
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.SetKey(fmt.Sprintf("key-%d", i), []byte("v")))
+	}
+	entries, err := db.GetReplicationBatch(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, uint64(3), entries[0].Seq)
+	require.NoError(t, db.CheckReplicationPosition(2))
+	require.ErrorIs(t, db.CheckReplicationPosition(1), ErrSnapshotRequired)
+	_, depth, err := db.ReplicationLogStats()
+	require.NoError(t, err)
+	require.Zero(t, depth, "nobody is waiting for the kept tail")
+
+	// a replica that registered holds it again
+	require.NoError(t, db.RegisterReplica("r1", 2))
+	for i := 5; i < 10; i++ {
+		require.NoError(t, db.SetKey(fmt.Sprintf("key-%d", i), []byte("v")))
+	}
+	entries, err = db.GetReplicationBatch(2, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 8)
+	_, depth, err = db.ReplicationLogStats()
+	require.NoError(t, err)
+	require.Equal(t, 8, depth)
+
+	// and once it is gone the log shrinks again
+	require.NoError(t, db.UnregisterReplica("r1"))
+	entries, err = db.GetReplicationBatch(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, uint64(8), entries[0].Seq)
+}
+
+func TestReplicationBatch(t *testing.T) {
+	leader, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, leader.SetKey(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.NoError(t, leader.DeleteKey("key-0"))
+
+	_, err := leader.GetReplicationBatch(0, 0)
+	require.Error(t, err)
+
+	batch, err := leader.GetReplicationBatch(0, 4)
+	require.NoError(t, err)
+	require.Len(t, batch, 4)
+	require.Equal(t, uint64(1), batch[0].Seq)
+	require.Equal(t, uint64(4), batch[3].Seq)
+
+	rest, err := leader.GetReplicationBatch(4, 100)
+	require.NoError(t, err)
+	require.Len(t, rest, 2)
+	require.True(t, rest[1].Deleted)
+
+	replicaPath := t.TempDir() + "/replica.db"
+	replica, closeReplica, err := NewDatabase(replicaPath, true)
+	require.NoError(t, err)
+	defer closeReplica()
+
+	require.NoError(t, replica.ApplyReplicationBatch(batch))
+	require.NoError(t, replica.ApplyReplicationBatch(rest))
+
+	seq, err := replica.LastAppliedSeq()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), seq)
+
+	_, err = replica.GetKey("key-0")
+	require.ErrorIs(t, err, ErrNotFound)
+	v, err := replica.GetKey("key-4")
 	require.NoError(t, err)
-	require.Nil(t, k)
-	require.Nil(t, v)
+	require.Equal(t, []byte("value-4"), v)
+
+	// a batch out of order is rejected as a whole
+	require.Error(t, replica.ApplyReplicationBatch([]LogEntry{{Seq: 8, Key: "x"}, {Seq: 7, Key: "y"}}))
+	seq, err = replica.LastAppliedSeq()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), seq)
+}
+
+func TestPromoteAndDemote(t *testing.T) {
+	replica, closeReplica, err := NewDatabase(t.TempDir()+"/replica.db", true)
+	require.NoError(t, err)
+	defer closeReplica()
+
+	require.NoError(t, replica.ApplyReplicationBatch([]LogEntry{
+		{Seq: 1, Key: "a", Value: []byte("1")},
+		{Seq: 2, Key: "b", Value: []byte("2")},
+	}))
+	require.Error(t, replica.SetKey("c", []byte("3")))
+
+	require.NoError(t, replica.Promote(1))
+	require.False(t, replica.ReadOnly())
+	require.Error(t, replica.Promote(1), "a term can only be won once")
+
+	// the log continues where the old leader left off
+	require.NoError(t, replica.SetKey("c", []byte("3")))
+	e, err := nextEntry(t, replica, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), e.Seq)
+
+	// a replica that applied less than we did can't catch up from our log
+	require.ErrorIs(t, replica.CheckReplicationPosition(1), ErrSnapshotRequired)
+	require.NoError(t, replica.CheckReplicationPosition(2))
+	require.ErrorIs(t, replica.CheckReplicationPosition(4), ErrSnapshotRequired)
+
+	require.NoError(t, replica.Demote(2))
+	require.True(t, replica.ReadOnly())
+	term, err := replica.Term()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), term)
+
+	// the writes of the lost term are gone from the log and the replica bootstraps again
+	ok, err := replica.IsBootstrapped()
+	require.NoError(t, err)
+	require.False(t, ok)
+	e, err = nextEntry(t, replica, 0)
+	require.NoError(t, err)
+	require.Nil(t, e)
+}
+
+func TestPromoteSplit(t *testing.T) {
+	child, closeChild, err := NewDatabase(t.TempDir()+"/child.db", true)
+	require.NoError(t, err)
+	defer closeChild()
+
+	require.NoError(t, child.ApplyReplicationBatch([]LogEntry{{Seq: 7, Key: "a", Value: []byte("1")}}))
+	done, err := child.SplitDone()
+	require.NoError(t, err)
+	require.False(t, done)
+
+	require.NoError(t, child.PromoteSplit())
+	require.False(t, child.ReadOnly())
+	done, err = child.SplitDone()
+	require.NoError(t, err)
+	require.True(t, done)
+
+	// the new shard's log continues the parent's numbering
+	seq, err := child.SetKeyWithSeq("b", []byte("2"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), seq)
+}
+
+func TestApplyReplicationReplay(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	seq, err := db.LastAppliedSeq()
+	require.NoError(t, err)
+	require.Zero(t, seq)
+
+	require.NoError(t, db.ApplyReplicationBatch([]LogEntry{{Seq: 1, Key: "k", Value: []byte("v1")}}))
+	require.NoError(t, db.ApplyReplicationBatch([]LogEntry{{Seq: 2, Key: "k", Value: []byte("v2")}}))
+
+	// replaying an old entry must not roll the value back
+	require.NoError(t, db.ApplyReplicationBatch([]LogEntry{{Seq: 1, Key: "k", Value: []byte("v1")}}))
+	v, err := db.GetKey("k")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), v)
+
+	require.NoError(t, db.ApplyReplicationBatch([]LogEntry{{Seq: 3, Key: "k", Deleted: true}}))
+	_, err = db.GetKey("k")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	seq, err = db.LastAppliedSeq()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), seq)
+
+	// replicas never write to their own replication log
+	e, err := nextEntry(t, db, 0)
+	require.NoError(t, err)
+	require.Nil(t, e)
+}
+
+func TestDeleteKey(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	require.NoError(t, db.SetKey("gone", []byte("soon")))
+	require.NoError(t, db.DeleteKey("gone"))
+
+	_, err := db.GetKey("gone")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// the delete shows up as a tombstone in the replication log
+	e, err := nextEntry(t, db, 1)
+	require.NoError(t, err)
+	require.Equal(t, "gone", e.Key)
+	require.Nil(t, e.Value)
+	require.True(t, e.Deleted)
+
+	// replicas apply the delete without touching the log
+	require.NoError(t, db.SetKeyOnReplica("other", []byte("x")))
+	require.NoError(t, db.DeleteKeyOnReplica("other"))
+	_, err = db.GetKey("other")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	e, err = nextEntry(t, db, e.Seq)
+	require.NoError(t, err)
+	require.Nil(t, e)
 }
 
 func TestReadOnlyMode(t *testing.T) {
@@ -108,5 +480,91 @@ func TestDeleteExtraKeys(t *testing.T) {
 	require.Equal(t, []byte("1"), v)
 
 	_, err = db.GetKey("b")
-	require.NoError(t, err) // Exists but should be nil
+	require.ErrorIs(t, err, ErrNotFound) // deleted as extra
+
+	// the replicas get the deletes through the log
+	entries, err := db.GetReplicationBatch(3, 10)
+	require.NoError(t, err)
+	require.Equal(t, []LogEntry{{Seq: 4, Key: "b", Deleted: true}, {Seq: 5, Key: "c", Deleted: true}}, entries)
+}
+
+func TestDeleteExtraKeysBatches(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer func(n int) { extraKeysBatch = n }(extraKeysBatch)
+	extraKeysBatch = 2
+
+	// more than one batch of keys to drop, every other key stays
+	for i := 0; i < 9; i++ {
+		require.NoError(t, db.SetKey(fmt.Sprintf("key-%d", i), []byte("v")))
+	}
+	require.NoError(t, db.DeleteExtraKeys(func(key string) bool { return key[len(key)-1]%2 == 1 }))
+
+	kept, err := db.Scan("", "", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, kept, 5)
+	entries, err := db.GetReplicationBatch(9, 10)
+	require.NoError(t, err)
+	var deleted []string
+	for _, e := range entries {
+		require.True(t, e.Deleted)
+		deleted = append(deleted, e.Key)
+	}
+	require.Equal(t, []string{"key-1", "key-3", "key-5", "key-7"}, deleted)
+
+	// a replica can't drop anything on its own
+	db.SetReadOnly(true)
+	require.ErrorIs(t, db.DeleteExtraKeys(func(string) bool { return true }), ErrReadOnly)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	missing := func(cur []byte) bool { return cur == nil }
+	seq, err := db.SetKeyIf("k", []byte("v1"), missing)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), seq)
+
+	_, err = db.SetKeyIf("k", []byte("v2"), missing)
+	require.ErrorIs(t, err, ErrConditionFailed)
+	v, err := db.GetKey("k")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(v))
+
+	// a failed check leaves nothing in the replication log
+	_, err = db.DeleteKeyIf("k", func(cur []byte) bool { return string(cur) == "v2" })
+	require.ErrorIs(t, err, ErrConditionFailed)
+	last, err := db.LastLogSeq()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), last)
+
+	seq, err = db.DeleteKeyIf("k", func(cur []byte) bool { return string(cur) == "v1" })
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), seq)
+
+	db.SetReadOnly(true)
+	_, err = db.SetKeyIf("k", []byte("v3"), nil)
+	require.ErrorIs(t, err, ErrReadOnly)
+}
+
+func TestScan(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, db.SetKey(k, []byte("v"+k)))
+	}
+
+	kvs, err := db.Scan("b", "d", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, []KeyValue{{Key: "b", Value: []byte("vb")}, {Key: "c", Value: []byte("vc")}}, kvs)
+
+	kvs, err = db.Scan("", "", 2, func(key string) bool { return key != "a" })
+	require.NoError(t, err)
+	require.Equal(t, []KeyValue{{Key: "b", Value: []byte("vb")}, {Key: "c", Value: []byte("vc")}}, kvs)
+
+	kvs, err = db.Scan("e", "", 0, nil)
+	require.NoError(t, err)
+	require.Empty(t, kvs)
 }
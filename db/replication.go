@@ -0,0 +1,698 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// the replication log is an append only log in replicaBucket
+// keys are big endian sequence numbers, so the bolt cursor walks them in commit order
+// two writes to the same key are two separate entries, nothing collapses
+// every replica has its own acked position in replicaAcksBucket, an entry is only dropped
+// once all registered replicas acked it, with no replica registered only the last logRetention entries are kept
+
+// every value starts with an op byte, so a delete can travel through the log
+// as a tombstone instead of just vanishing
+const (
+	opSet    byte = 's'
+	opDelete byte = 'd'
+)
+
+// the replica keeps the sequence number of the last entry it applied under this key
+var appliedSeqKey = []byte("applied-seq")
+
+// the leader keeps the highest sequence number that is no longer in its log under this key,
+// a replica behind it can't catch up from the log and needs a snapshot
+var logFloorKey = []byte("log-floor")
+
+// the failover term this node last saw, it only ever grows
+var termKey = []byte("term")
+
+// set once a new shard took over its keys from the shard it was split off
+var splitDoneKey = []byte("split-done")
+
+// logRetention is how many entries the log keeps while no replica is registered, enough for a replica
+// that is about to register to catch up without a snapshot, without the log growing forever
+var logRetention uint64 = 10000
+
+// ErrSnapshotRequired is returned when a replica asks for entries the log can't provide, either because
+// they were dropped already or because the replica is ahead of the log after a failover.
+var ErrSnapshotRequired = errors.New("position not in replication log, snapshot required")
+
+// ErrUnknownSeq is returned when a replica acks a position the log never reached.
+var ErrUnknownSeq = errors.New("sequence number was never written")
+
+// LogEntry is a single write in the replication log.
+// Value is nil for tombstones.
+type LogEntry struct {
+	Seq     uint64
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+func seqKey(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+// op byte | uvarint key length | key | value
+func encodeLogEntry(e LogEntry) []byte {
+	op := opSet
+	if e.Deleted {
+		op = opDelete
+	}
+
+	res := make([]byte, 0, 1+binary.MaxVarintLen64+len(e.Key)+len(e.Value))
+	res = append(res, op)
+	res = binary.AppendUvarint(res, uint64(len(e.Key)))
+	res = append(res, e.Key...)
+	return append(res, e.Value...)
+}
+
+// decodeLogEntry copies everything out of v, bolt memory is only valid inside the transaction
+func decodeLogEntry(k, v []byte) (LogEntry, error) {
+	if len(k) != 8 || len(v) == 0 {
+		return LogEntry{}, fmt.Errorf("malformed replication log entry %x", k)
+	}
+
+	e := LogEntry{Seq: binary.BigEndian.Uint64(k)}
+	switch v[0] {
+	case opSet:
+	case opDelete:
+		e.Deleted = true
+	default:
+		return LogEntry{}, fmt.Errorf("unknown op %q in replication log entry %d", v[0], e.Seq)
+	}
+
+	keyLen, n := binary.Uvarint(v[1:])
+	if n <= 0 || uint64(len(v)-1-n) < keyLen {
+		return LogEntry{}, fmt.Errorf("malformed replication log entry %d", e.Seq)
+	}
+	rest := v[1+n:]
+	e.Key = string(rest[:keyLen])
+	if !e.Deleted {
+		e.Value = copyByteSlice(rest[keyLen:])
+	}
+	return e, nil
+}
+
+// appendToLog assigns the next sequence number to the entry and writes it to the log
+// must be called inside the same transaction as the write it describes
+func appendToLog(tx *bolt.Tx, e LogEntry) (uint64, error) {
+	b := tx.Bucket(replicaBucket)
+	seq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	e.Seq = seq
+	return seq, b.Put(seqKey(seq), encodeLogEntry(e))
+}
+
+// LogChanged returns a channel that is closed the next time a write is committed to the replication log.
+// Grab the channel before reading the log, otherwise a commit in between is missed.
+func (d *Database) LogChanged() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.logChanged
+}
+
+// wakes up everyone waiting on LogChanged, only called after the transaction committed
+func (d *Database) notifyLogChanged() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.logChanged)
+	d.logChanged = make(chan struct{})
+}
+
+// AcksChanged returns a channel that is closed the next time a replica acks.
+// Grab the channel before counting acks, otherwise an ack in between is missed.
+func (d *Database) AcksChanged() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.acksChanged
+}
+
+func (d *Database) notifyAcksChanged() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.acksChanged)
+	d.acksChanged = make(chan struct{})
+}
+
+// HoldLog keeps the log entries after seq from being dropped, for readers of the log that are not
+// registered replicas, like a watch. move shifts the hold to a later position once the reader got there,
+// release drops it. Holds live in memory only, a restart forgets them.
+func (d *Database) HoldLog(seq uint64) (move func(seq uint64), release func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.nextHold
+	d.nextHold++
+	d.holds[id] = seq
+
+	move = func(seq uint64) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, ok := d.holds[id]; ok {
+			d.holds[id] = seq
+		}
+	}
+	release = func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.holds, id)
+	}
+	return move, release
+}
+
+// heldFrom returns the lowest position a hold keeps the log after, false without holds
+func (d *Database) heldFrom() (uint64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var seq uint64
+	first := true
+	for _, held := range d.holds {
+		if first || held < seq {
+			seq = held
+		}
+		first = false
+	}
+	return seq, !first
+}
+
+// AckedBy counts how many of the given replicas acked seq or anything after it.
+func (d *Database) AckedBy(seq uint64, replicaIDs []string) (int, error) {
+	n := 0
+	err := d.db.View(func(tx *bolt.Tx) error {
+		acks := tx.Bucket(replicaAcksBucket)
+		for _, id := range replicaIDs {
+			if readSeq(acks, []byte(id)) >= seq {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// GetReplicationBatch returns up to limit log entries with a sequence number greater than after,
+// in commit order. An empty result means the replica is caught up.
+func (d *Database) GetReplicationBatch(after uint64, limit int) ([]LogEntry, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid batch size %d", limit)
+	}
+
+	var res []LogEntry
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(replicaBucket).Cursor()
+		for k, v := c.Seek(seqKey(after + 1)); k != nil && len(res) < limit; k, v = c.Next() {
+			e, err := decodeLogEntry(k, v)
+			if err != nil {
+				return err
+			}
+			res = append(res, e)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RegisterReplica starts tracking the replica at position seq, the log keeps everything after it
+// until the replica acks. Registering an already known replica does nothing.
+// A position the log never reached is refused with ErrSnapshotRequired, it would count as acks for writes
+// the replica never got.
+func (d *Database) RegisterReplica(replicaID string, seq uint64) error {
+	if replicaID == "" {
+		return errors.New("empty replica id")
+	}
+
+	// every pull registers, so keep the common case a cheap read
+	var known bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		known = tx.Bucket(replicaAcksBucket).Get([]byte(replicaID)) != nil
+		if last := tx.Bucket(replicaBucket).Sequence(); !known && seq > last {
+			return fmt.Errorf("%w: replica at %d, last seq is %d", ErrSnapshotRequired, seq, last)
+		}
+		return nil
+	})
+	if err != nil || known {
+		return err
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(replicaAcksBucket)
+		if b.Get([]byte(replicaID)) != nil {
+			return nil
+		}
+		return b.Put([]byte(replicaID), seqKey(seq))
+	})
+}
+
+// ResetReplica tracks the replica at position seq whatever it acked before, for a replica that starts over
+// from a snapshot.
+func (d *Database) ResetReplica(replicaID string, seq uint64) error {
+	if replicaID == "" {
+		return errors.New("empty replica id")
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if last := tx.Bucket(replicaBucket).Sequence(); seq > last {
+			return fmt.Errorf("%w: reset to %d, last seq is %d", ErrUnknownSeq, seq, last)
+		}
+		if err := tx.Bucket(replicaAcksBucket).Put([]byte(replicaID), seqKey(seq)); err != nil {
+			return err
+		}
+		return d.trimLog(tx)
+	})
+}
+
+// UnregisterReplica stops tracking the replica, so a decommissioned replica
+// does not hold back the log forever.
+func (d *Database) UnregisterReplica(replicaID string) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(replicaAcksBucket).Delete([]byte(replicaID)); err != nil {
+			return err
+		}
+		return d.trimLog(tx)
+	})
+}
+
+// DeleteReplicationKey records that the replica applied every log entry up to and including seq,
+// and drops the entries that all registered replicas have acked.
+// acking the same seq twice is fine, acking something that was never written is not
+func (d *Database) DeleteReplicationKey(replicaID string, seq uint64) error {
+	if replicaID == "" {
+		return errors.New("empty replica id")
+	}
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		if last := tx.Bucket(replicaBucket).Sequence(); seq > last {
+			return fmt.Errorf("%w: acked %d, last seq is %d", ErrUnknownSeq, seq, last)
+		}
+
+		acks := tx.Bucket(replicaAcksBucket)
+		if v := acks.Get([]byte(replicaID)); v != nil && binary.BigEndian.Uint64(v) >= seq {
+			return nil
+		}
+		if err := acks.Put([]byte(replicaID), seqKey(seq)); err != nil {
+			return err
+		}
+
+		return d.trimLog(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.notifyAcksChanged()
+	return nil
+}
+
+// ReplicaPositions returns the acked position of every registered replica.
+func (d *Database) ReplicaPositions() (map[string]uint64, error) {
+	res := make(map[string]uint64)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(replicaAcksBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				return fmt.Errorf("malformed ack position for replica %q", k)
+			}
+			res[string(k)] = binary.BigEndian.Uint64(v)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// trimLog drops the log entries every registered replica has acked and no hold keeps
+// with no registered replicas it drops all but the last logRetention
+func (d *Database) trimLog(tx *bolt.Tx) error {
+	b := tx.Bucket(replicaBucket)
+	minSeq := b.Sequence()
+	replicas := false
+	err := tx.Bucket(replicaAcksBucket).ForEach(func(k, v []byte) error {
+		if len(v) != 8 {
+			return fmt.Errorf("malformed ack position for replica %q", k)
+		}
+		if seq := binary.BigEndian.Uint64(v); seq < minSeq {
+			minSeq = seq
+		}
+		replicas = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !replicas {
+		minSeq -= min(minSeq, logRetention)
+	}
+	if held, ok := d.heldFrom(); ok && held < minSeq {
+		minSeq = held
+	}
+
+	// deleting while iterating confuses the cursor, collect first
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= minSeq; k, _ = c.Next() {
+		keys = append(keys, copyByteSlice(k))
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	state := tx.Bucket(replicaStateBucket)
+	if minSeq > readSeq(state, logFloorKey) {
+		return state.Put(logFloorKey, seqKey(minSeq))
+	}
+	return nil
+}
+
+// CheckReplicationPosition tells whether a replica that applied everything up to after
+// can continue from the log, and returns ErrSnapshotRequired if not.
+func (d *Database) CheckReplicationPosition(after uint64) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		floor := readSeq(tx.Bucket(replicaStateBucket), logFloorKey)
+		last := tx.Bucket(replicaBucket).Sequence()
+		if after < floor || after > last {
+			return fmt.Errorf("%w: replica at %d, log holds %d-%d", ErrSnapshotRequired, after, floor, last)
+		}
+		return nil
+	})
+}
+
+// ApplyReplicationBatch applies log entries pulled from the leader in a single transaction and records
+// the sequence number of the last one, so a crash never leaves the data and the position out of sync.
+// Entries at or below the last applied sequence are skipped, replaying is harmless.
+// This method is intended to be used only on replicas.
+func (d *Database) ApplyReplicationBatch(entries []LogEntry) error {
+	for i, e := range entries {
+		if e.Seq == 0 {
+			return errors.New("log entry without a sequence number")
+		}
+		if i > 0 && e.Seq <= entries[i-1].Seq {
+			return fmt.Errorf("log entries out of order: %d after %d", e.Seq, entries[i-1].Seq)
+		}
+	}
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		state := tx.Bucket(replicaStateBucket)
+		b := tx.Bucket(defaultBucket)
+		applied := appliedSeq(state)
+
+		for _, e := range entries {
+			if e.Seq <= applied {
+				continue
+			}
+
+			var err error
+			if e.Deleted {
+				err = b.Delete([]byte(e.Key))
+			} else {
+				err = b.Put([]byte(e.Key), e.Value)
+			}
+			if err != nil {
+				return err
+			}
+			applied = e.Seq
+		}
+
+		return state.Put(appliedSeqKey, seqKey(applied))
+	})
+}
+
+// LastAppliedSeq returns the sequence number of the last log entry applied on this replica,
+// 0 if nothing has been applied yet.
+func (d *Database) LastAppliedSeq() (uint64, error) {
+	var seq uint64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		seq = appliedSeq(tx.Bucket(replicaStateBucket))
+		return nil
+	})
+	return seq, err
+}
+
+func appliedSeq(state *bolt.Bucket) uint64 {
+	return readSeq(state, appliedSeqKey)
+}
+
+func readSeq(b *bolt.Bucket, key []byte) uint64 {
+	v := b.Get(key)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+// ReplicationLogStats returns the sequence number of the last write and the number of writes
+// the furthest behind replica has not acked, read in one transaction so they agree with each other.
+// The depth is 0 with no registered replica, whatever the log keeps for later ones or for watches.
+func (d *Database) ReplicationLogStats() (lastSeq uint64, depth int, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		lastSeq = tx.Bucket(replicaBucket).Sequence()
+		minSeq := lastSeq
+		err := tx.Bucket(replicaAcksBucket).ForEach(func(k, v []byte) error {
+			if len(v) != 8 {
+				return fmt.Errorf("malformed ack position for replica %q", k)
+			}
+			minSeq = min(minSeq, binary.BigEndian.Uint64(v))
+			return nil
+		})
+		depth = int(lastSeq - minSeq)
+		return err
+	})
+	return lastSeq, depth, err
+}
+
+// LastLogSeq returns the sequence number of the last write appended to the replication log.
+func (d *Database) LastLogSeq() (uint64, error) {
+	var seq uint64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		seq = tx.Bucket(replicaBucket).Sequence()
+		return nil
+	})
+	return seq, err
+}
+
+// WriteSnapshot writes a consistent copy of the whole bolt file to the writer returned by start.
+// start is called first with the replication sequence number the copy corresponds to and its size,
+// so the caller can send both ahead of the data.
+func (d *Database) WriteSnapshot(start func(seq uint64, size int64) io.Writer) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		w := start(tx.Bucket(replicaBucket).Sequence(), tx.Size())
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// IsBootstrapped tells whether this replica already holds data from its leader,
+// either from a snapshot or from applying the log.
+func (d *Database) IsBootstrapped() (bool, error) {
+	var ok bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(replicaStateBucket).Get(appliedSeqKey) != nil
+		return nil
+	})
+	return ok, err
+}
+
+// InstallSnapshot replaces the data of this replica with the contents of a snapshot written by WriteSnapshot
+// on the leader, and records seq as the last applied position so the replica tails the log from there.
+// This method is intended to be used only on replicas.
+func (d *Database) InstallSnapshot(r io.Reader, seq uint64) error {
+	// bolt can only read a database from a file, so stage it next to ours
+	f, err := os.CreateTemp(filepath.Dir(d.db.Path()), filepath.Base(d.db.Path())+".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("receiving snapshot: %w", err)
+	}
+
+	snap, err := bolt.Open(f.Name(), 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("opening snapshot: %w", err)
+	}
+	defer snap.Close()
+
+	return snap.View(func(src *bolt.Tx) error {
+		from := src.Bucket(defaultBucket)
+		if from == nil {
+			return errors.New("snapshot has no default bucket")
+		}
+
+		// only user data is copied, the leader's own log and ack positions mean nothing here
+		return d.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket(defaultBucket); err != nil {
+				return err
+			}
+			to, err := tx.CreateBucket(defaultBucket)
+			if err != nil {
+				return err
+			}
+
+			err = from.ForEach(func(k, v []byte) error {
+				return to.Put(copyByteSlice(k), copyByteSlice(v))
+			})
+			if err != nil {
+				return err
+			}
+
+			return tx.Bucket(replicaStateBucket).Put(appliedSeqKey, seqKey(seq))
+		})
+	})
+}
+
+// ResetReplicationState forgets how far this replica got, so the next start of replication
+// bootstraps from a fresh snapshot of the leader.
+// This method is intended to be used only on replicas.
+func (d *Database) ResetReplicationState() error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(replicaStateBucket).Delete(appliedSeqKey)
+	})
+}
+
+// Term returns the failover term this node last saw.
+func (d *Database) Term() (uint64, error) {
+	var term uint64
+	err := d.db.View(func(tx *bolt.Tx) error {
+		term = readSeq(tx.Bucket(replicaStateBucket), termKey)
+		return nil
+	})
+	return term, err
+}
+
+// SetTerm records a newer failover term, an older one is ignored.
+func (d *Database) SetTerm(term uint64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		state := tx.Bucket(replicaStateBucket)
+		if term <= readSeq(state, termKey) {
+			return nil
+		}
+		return state.Put(termKey, seqKey(term))
+	})
+}
+
+// Promote turns this replica into the leader of term.
+// The new log starts empty right after the last applied entry, so a replica that is behind that
+// (or ahead of it) has to start over from a full snapshot. Writes are accepted from now on.
+func (d *Database) Promote(term uint64) error {
+	return d.promote(term, nil)
+}
+
+// promote is Promote that lets the caller record more state in the same transaction
+func (d *Database) promote(term uint64, also func(state *bolt.Bucket) error) error {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		state := tx.Bucket(replicaStateBucket)
+		if term <= readSeq(state, termKey) {
+			return fmt.Errorf("term %d is not newer than %d", term, readSeq(state, termKey))
+		}
+		applied := appliedSeq(state)
+
+		// whatever is left from an earlier reign was never seen by the others
+		if err := recreateBucket(tx, replicaBucket); err != nil {
+			return err
+		}
+		if err := recreateBucket(tx, replicaAcksBucket); err != nil {
+			return err
+		}
+		if err := tx.Bucket(replicaBucket).SetSequence(applied); err != nil {
+			return err
+		}
+
+		if err := state.Put(logFloorKey, seqKey(applied)); err != nil {
+			return err
+		}
+		if also != nil {
+			if err := also(state); err != nil {
+				return err
+			}
+		}
+		return state.Put(termKey, seqKey(term))
+	})
+	if err != nil {
+		return err
+	}
+
+	d.readOnly.Store(false)
+	return nil
+}
+
+// PromoteSplit turns a new shard that copied its parent's keys into the leader of its own shard.
+// The split is recorded, so a restart does not go back to copying from the parent.
+func (d *Database) PromoteSplit() error {
+	term, err := d.Term()
+	if err != nil {
+		return err
+	}
+	return d.promote(term+1, func(state *bolt.Bucket) error {
+		return state.Put(splitDoneKey, []byte{1})
+	})
+}
+
+// SplitDone tells whether PromoteSplit ran on this database.
+func (d *Database) SplitDone() (bool, error) {
+	var done bool
+	err := d.db.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket(replicaStateBucket).Get(splitDoneKey) != nil
+		return nil
+	})
+	return done, err
+}
+
+// Demote turns this leader into a replica of a newer term. Its own log is dropped and it forgets
+// its replication position, so it bootstraps from the new leader and drops writes nobody else saw.
+func (d *Database) Demote(term uint64) error {
+	// stop taking writes before anything else
+	d.readOnly.Store(true)
+
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if err := recreateBucket(tx, replicaBucket); err != nil {
+			return err
+		}
+		if err := recreateBucket(tx, replicaAcksBucket); err != nil {
+			return err
+		}
+
+		state := tx.Bucket(replicaStateBucket)
+		if err := state.Delete(appliedSeqKey); err != nil {
+			return err
+		}
+		if err := state.Delete(logFloorKey); err != nil {
+			return err
+		}
+		if term > readSeq(state, termKey) {
+			return state.Put(termKey, seqKey(term))
+		}
+		return nil
+	})
+}
+
+func recreateBucket(tx *bolt.Tx, name []byte) error {
+	if err := tx.DeleteBucket(name); err != nil {
+		return err
+	}
+	_, err := tx.CreateBucket(name)
+	return err
+}
@@ -0,0 +1,163 @@
+package failover
+
+import (
+	"encoding/json"
+	"fmt"
+	"kv/config"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the directory is every node's view of who leads each shard
+// it starts out with the leader addresses from the config and follows failovers by asking
+// the shard's nodes for their State whenever the known leader stops answering
+
+// State is what every node reports on /failover/state.
+// Seq is the last log sequence number on a leader and the last applied one on a replica, so the two compare.
+// LeaderContactAge is how long ago a replica last heard from its leader.
+type State struct {
+	Addr             string        `json:"addr"`
+	Shard            int           `json:"shard"`
+	Term             uint64        `json:"term"`
+	Leader           string        `json:"leader"`
+	IsLeader         bool          `json:"is_leader"`
+	Seq              uint64        `json:"seq"`
+	LeaderContactAge time.Duration `json:"leader_contact_age,omitempty"`
+}
+
+type Directory struct {
+	httpClient *http.Client
+
+	mu      sync.RWMutex
+	shards  *config.Shards
+	leaders map[int]string
+	terms   map[int]uint64
+	alive   func(addr string) bool // nil trusts every node
+}
+
+func NewDirectory(shards *config.Shards) *Directory {
+	d := &Directory{
+		shards:     shards,
+		httpClient: &http.Client{Timeout: time.Second},
+		leaders:    make(map[int]string),
+		terms:      make(map[int]uint64),
+	}
+	for idx, addr := range shards.Addrs {
+		d.leaders[idx] = addr
+	}
+	return d
+}
+
+// Leader returns the address of the node currently believed to lead the shard.
+func (d *Directory) Leader(shard int) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.leaders[shard]
+}
+
+// Observe records that addr leads the shard in term, unless a newer term is known already.
+// It returns true if the leader changed.
+func (d *Directory) Observe(shard int, addr string, term uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if term < d.terms[shard] || d.leaders[shard] == addr {
+		if term > d.terms[shard] {
+			d.terms[shard] = term
+		}
+		return false
+	}
+	d.leaders[shard] = addr
+	d.terms[shard] = term
+	return true
+}
+
+// Candidates returns every node that may lead the shard, the configured leader first.
+func (d *Directory) Candidates(shard int) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	res := []string{d.shards.Addrs[shard]}
+	return append(res, d.shards.Replicas[shard]...)
+}
+
+// SetHealthCheck makes failover skip the nodes alive reports as down, e.g. from gossip membership.
+func (d *Directory) SetHealthCheck(alive func(addr string) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.alive = alive
+}
+
+// liveCandidates returns the candidates that are not known to be down
+func (d *Directory) liveCandidates(shard int) []string {
+	d.mu.RLock()
+	alive := d.alive
+	d.mu.RUnlock()
+
+	var res []string
+	for _, addr := range d.Candidates(shard) {
+		if alive == nil || alive(addr) {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// SetShards switches to a new shard layout, e.g. after a split.
+// Leaders known for shards that are still there are kept, new shards start with their configured leader.
+func (d *Directory) SetShards(shards *config.Shards) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.shards = shards
+	for idx, addr := range shards.Addrs {
+		if _, ok := d.leaders[idx]; !ok {
+			d.leaders[idx] = addr
+		}
+	}
+	for idx := range d.leaders {
+		if _, ok := shards.Addrs[idx]; !ok {
+			delete(d.leaders, idx)
+			delete(d.terms, idx)
+		}
+	}
+}
+
+// Refresh asks every node of the shard who leads it and returns the leader with the highest term.
+// If nobody claims to lead, the known leader is kept.
+func (d *Directory) Refresh(shard int) string {
+	var best *State
+	for _, addr := range d.liveCandidates(shard) {
+		st, err := FetchState(d.httpClient, addr)
+		if err != nil || !st.IsLeader {
+			continue
+		}
+		if best == nil || st.Term > best.Term {
+			best = &st
+		}
+	}
+
+	if best != nil {
+		d.Observe(shard, best.Addr, best.Term)
+	}
+	return d.Leader(shard)
+}
+
+// FetchState asks the node at addr for its failover state.
+func FetchState(hc *http.Client, addr string) (State, error) {
+	var st State
+	resp, err := hc.Get("http://" + addr + "/failover/state")
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("%s answered %d", addr, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return st, fmt.Errorf("decoding state of %s: %w", addr, err)
+	}
+	return st, nil
+}
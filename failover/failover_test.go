@@ -0,0 +1,100 @@
+package failover
+
+import (
+	"encoding/json"
+	"kv/config"
+	"kv/db"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stateServer serves a fixed failover state, addr is filled in once the server runs
+func stateServer(t *testing.T, st State) string {
+	t.Helper()
+
+	var addr string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st.Addr = addr
+		json.NewEncoder(w).Encode(st)
+	}))
+	t.Cleanup(ts.Close)
+
+	addr = strings.TrimPrefix(ts.URL, "http://")
+	return addr
+}
+
+func TestDirectory_Refresh(t *testing.T) {
+	// the configured leader is gone, one replica took over in term 2, another one still follows term 1
+	dead := "127.0.0.1:1"
+	oldTerm := stateServer(t, State{Term: 1, IsLeader: true})
+	newTerm := stateServer(t, State{Term: 2, IsLeader: true})
+	follower := stateServer(t, State{Term: 2, Leader: newTerm})
+
+	dir := NewDirectory(&config.Shards{
+		Count:    1,
+		Addrs:    map[int]string{0: dead},
+		Replicas: map[int][]string{0: {oldTerm, newTerm, follower}},
+	})
+	require.Equal(t, dead, dir.Leader(0))
+	require.Equal(t, []string{dead, oldTerm, newTerm, follower}, dir.Candidates(0))
+
+	require.Equal(t, newTerm, dir.Refresh(0))
+	require.Equal(t, newTerm, dir.Leader(0))
+
+	// an older term never wins over a newer one
+	require.False(t, dir.Observe(0, oldTerm, 1))
+	require.Equal(t, newTerm, dir.Leader(0))
+	require.True(t, dir.Observe(0, oldTerm, 3))
+}
+
+func TestBetterCandidate(t *testing.T) {
+	a := State{Addr: "127.0.0.22:8080", Seq: 10}
+	b := State{Addr: "127.0.0.23:8080", Seq: 12}
+	require.True(t, betterCandidate(b, a))
+	require.False(t, betterCandidate(a, b))
+
+	// on equal progress every replica has to pick the same one
+	b.Seq = 10
+	require.True(t, betterCandidate(a, b))
+	require.False(t, betterCandidate(b, a))
+}
+
+func TestNode_Lease(t *testing.T) {
+	database, closeFunc, err := db.NewDatabase(filepath.Join(t.TempDir(), "lease.db"), false)
+	require.NoError(t, err)
+	t.Cleanup(func() { closeFunc() })
+
+	self, r1, r2 := "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"
+	dir := NewDirectory(&config.Shards{
+		Count:    1,
+		Addrs:    map[int]string{0: self},
+		Replicas: map[int][]string{0: {r1, r2}},
+	})
+	lease := 50 * time.Millisecond
+	n, err := NewNode(database, dir, 0, Options{Self: self, LeaseTimeout: lease})
+	require.NoError(t, err)
+
+	// a new leader gets a whole lease before it counts on its replicas
+	n.grantLease()
+	n.checkLease()
+	require.False(t, database.ReadOnly())
+
+	// nobody pulled within a lease, a replica may take over by now
+	time.Sleep(lease)
+	n.checkLease()
+	require.True(t, database.ReadOnly())
+	require.True(t, n.State().IsLeader)
+	require.Error(t, database.SetKey("k", []byte("v")))
+
+	// one of two replicas makes a majority of the shard again
+	n.Pulled(r1)
+	n.checkLease()
+	require.False(t, database.ReadOnly())
+	require.NoError(t, database.SetKey("k", []byte("v")))
+}
@@ -0,0 +1,440 @@
+package failover
+
+import (
+	"errors"
+	"fmt"
+	"kv/db"
+	"kv/replication"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// lease based leader election among the leader and the configured replicas of a shard
+//
+// a leader holds a lease while it and the replicas that pulled from it within LeaseTimeout are a majority
+// of the shard, it stops taking writes as soon as the lease runs out and takes them again once enough
+// replicas are back
+//
+// every replica checks its leader every LeaseTimeout/3
+// once the leader has been silent for two leases, so it surely stopped taking writes, the replica asks
+// the other nodes of the shard:
+//   - if one of them already leads a newer term, follow it
+//   - if one of them still hears from the leader, it is only us who can't reach it, do nothing
+//   - otherwise the most up-to-date replica (highest applied seq, lowest address on ties)
+//     promotes itself to leader of the next term, everyone else follows it once it shows up
+//
+// a leader keeps checking the other nodes too, and steps down as soon as one of them leads a newer term
+// (e.g. the old leader coming back after a failover), dropping the writes nobody else saw
+//
+// there is no quorum among the replicas, so a split that cuts replicas off from each other but not all of
+// them from the leader can still produce two leaders until it heals
+
+type Options struct {
+	Self string // our own address, as listed in the config
+
+	// LeaseTimeout is how long a leader takes writes without hearing from enough replicas,
+	// replicas wait twice as long for a silent leader before one of them takes over. 0 disables failover
+	LeaseTimeout time.Duration
+
+	// Replication is used for the replication client while this node is a replica, ReplicaID is set to Self
+	Replication replication.Options
+
+	// OnReplicationClient is called whenever the replication client changes, nil once this node leads
+	OnReplicationClient func(*replication.Client)
+}
+
+// Node runs failover for the shard this process belongs to.
+type Node struct {
+	db         *db.Database
+	dir        *Directory
+	shard      int
+	opts       Options
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	term      uint64
+	client    *replication.Client
+	lastHeard time.Time
+	pulls     map[string]time.Time // when each replica last pulled from us while we lead
+	fenced    bool                 // we lead but our lease ran out, the database refuses writes
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
+}
+
+func NewNode(database *db.Database, dir *Directory, shard int, opts Options) (*Node, error) {
+	if opts.Self == "" {
+		return nil, errors.New("empty self address")
+	}
+	if opts.LeaseTimeout < 0 {
+		return nil, fmt.Errorf("negative lease timeout %s", opts.LeaseTimeout)
+	}
+	opts.Replication.ReplicaID = opts.Self
+
+	term, err := database.Term()
+	if err != nil {
+		return nil, fmt.Errorf("reading failover term: %w", err)
+	}
+
+	return &Node{
+		db:         database,
+		dir:        dir,
+		shard:      shard,
+		opts:       opts,
+		httpClient: &http.Client{Timeout: time.Second},
+		term:       term,
+		pulls:      make(map[string]time.Time),
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+// Directory returns the leader directory this node keeps up to date.
+func (n *Node) Directory() *Directory {
+	return n.dir
+}
+
+// Self returns our own address.
+func (n *Node) Self() string {
+	return n.opts.Self
+}
+
+// Start begins replicating if this node is a replica and starts watching the leader.
+// A leader first makes sure nobody took over while it was gone.
+func (n *Node) Start() error {
+	// the term may have moved since NewNode, a shard taking over from its split parent starts one
+	term, err := n.db.Term()
+	if err != nil {
+		return fmt.Errorf("reading failover term: %w", err)
+	}
+	n.mu.Lock()
+	if term > n.term {
+		n.term = term
+	}
+	n.mu.Unlock()
+
+	if n.db.ReadOnly() {
+		if err := n.follow(n.dir.Leader(n.shard), n.term); err != nil {
+			return err
+		}
+	} else {
+		n.dir.Observe(n.shard, n.opts.Self, n.term)
+		n.grantLease()
+		n.checkForNewerLeader()
+	}
+
+	if n.opts.LeaseTimeout > 0 {
+		n.running.Add(1)
+		go n.run()
+	}
+	return nil
+}
+
+// State returns this node's failover state, as served on /failover/state.
+func (n *Node) State() State {
+	n.mu.Lock()
+	st := State{
+		Addr:     n.opts.Self,
+		Shard:    n.shard,
+		Term:     n.term,
+		Leader:   n.dir.Leader(n.shard),
+		IsLeader: !n.db.ReadOnly() || n.fenced,
+	}
+	lastHeard := n.lastHeard
+	n.mu.Unlock()
+
+	if st.IsLeader {
+		st.Seq, _ = n.db.LastLogSeq()
+	} else {
+		st.Seq, _ = n.db.LastAppliedSeq()
+		st.LeaderContactAge = time.Since(lastHeard)
+	}
+	return st
+}
+
+// Stop ends failover and replication, the node keeps whatever role it has right now.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() { close(n.stop) })
+	// a check that is underway may still start replicating
+	n.running.Wait()
+	n.stopReplication()
+}
+
+func (n *Node) run() {
+	defer n.running.Done()
+	t := time.NewTicker(n.opts.LeaseTimeout / 3)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-n.stop:
+			return
+		}
+		if n.leading() {
+			n.checkForNewerLeader()
+			n.checkLease()
+			continue
+		}
+		n.checkLeader()
+	}
+}
+
+// checkLeader renews the lease when the leader answers and starts an election when it stays silent
+func (n *Node) checkLeader() {
+	leader := n.dir.Leader(n.shard)
+	st, err := FetchState(n.httpClient, leader)
+
+	n.mu.Lock()
+	term := n.term
+	if err == nil && st.IsLeader && st.Term >= term {
+		n.lastHeard = time.Now()
+	}
+	silent := time.Since(n.lastHeard)
+	n.mu.Unlock()
+
+	switch {
+	case err == nil && st.IsLeader && st.Term > term:
+		n.adoptTerm(st.Term)
+	case err == nil && !st.IsLeader && st.Leader != "" && st.Leader != leader && st.Term > term:
+		// the node we follow stepped down and knows who took over
+		n.followLogged(st.Leader, st.Term)
+	case silent >= 2*n.opts.LeaseTimeout:
+		// a leader that lost us stops taking writes after one lease, give it a second one to get there
+		n.elect(leader)
+	}
+}
+
+// elect runs when the leader has been silent for two leases
+func (n *Node) elect(deadLeader string) {
+	n.mu.Lock()
+	term := n.term
+	n.mu.Unlock()
+
+	self := n.State()
+	best := self
+	maxTerm := term
+
+	for _, addr := range n.dir.liveCandidates(n.shard) {
+		if addr == n.opts.Self || addr == deadLeader {
+			continue
+		}
+		st, err := FetchState(n.httpClient, addr)
+		if err != nil {
+			continue
+		}
+
+		if st.IsLeader && st.Term > term {
+			n.followLogged(st.Addr, st.Term)
+			return
+		}
+		if !st.IsLeader && st.Leader == deadLeader && st.LeaderContactAge < n.opts.LeaseTimeout {
+			// somebody else still reaches the leader, the problem is on our side
+			return
+		}
+
+		if st.Term > maxTerm {
+			maxTerm = st.Term
+		}
+		if !st.IsLeader && betterCandidate(st, best) {
+			best = st
+		}
+	}
+
+	if best.Addr != n.opts.Self {
+		log.Printf("Failover: leader %s is silent, waiting for %s (seq %d) to take over", deadLeader, best.Addr, best.Seq)
+		return
+	}
+
+	if err := n.promote(maxTerm + 1); err != nil {
+		log.Printf("Failover: promotion failed: %v", err)
+	}
+}
+
+// betterCandidate prefers the replica that applied more, and the lowest address on ties,
+// so every replica comes to the same conclusion
+func betterCandidate(a, b State) bool {
+	if a.Seq != b.Seq {
+		return a.Seq > b.Seq
+	}
+	return a.Addr < b.Addr
+}
+
+// checkForNewerLeader makes a leader step down if another node leads a newer term
+func (n *Node) checkForNewerLeader() {
+	n.mu.Lock()
+	term := n.term
+	n.mu.Unlock()
+
+	for _, addr := range n.dir.liveCandidates(n.shard) {
+		if addr == n.opts.Self {
+			continue
+		}
+		st, err := FetchState(n.httpClient, addr)
+		if err == nil && st.IsLeader && st.Term > term {
+			n.followLogged(st.Addr, st.Term)
+			return
+		}
+	}
+}
+
+func (n *Node) promote(term uint64) error {
+	n.stopReplication()
+
+	if err := n.db.Promote(term); err != nil {
+		// keep replicating from whoever leads, the next round tries again
+		n.startReplication(n.dir.Leader(n.shard))
+		return err
+	}
+
+	n.mu.Lock()
+	n.term = term
+	n.mu.Unlock()
+	n.dir.Observe(n.shard, n.opts.Self, term)
+	n.grantLease()
+
+	log.Printf("Failover: %s is now the leader of shard %d in term %d", n.opts.Self, n.shard, term)
+	return nil
+}
+
+func (n *Node) followLogged(leader string, term uint64) {
+	if err := n.follow(leader, term); err != nil {
+		log.Printf("Failover: following %s in term %d failed: %v", leader, term, err)
+		return
+	}
+	log.Printf("Failover: %s follows %s in term %d", n.opts.Self, leader, term)
+}
+
+// follow makes this node a replica of leader, stepping down first if it leads right now
+func (n *Node) follow(leader string, term uint64) error {
+	if n.leading() {
+		if err := n.db.Demote(term); err != nil {
+			return err
+		}
+	} else if err := n.db.SetTerm(term); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.fenced = false
+	if term > n.term {
+		n.term = term
+	}
+	// a new leader gets a full lease before anyone gives up on it
+	n.lastHeard = time.Now()
+	n.mu.Unlock()
+
+	n.dir.Observe(n.shard, leader, term)
+	n.stopReplication()
+	return n.startReplication(leader)
+}
+
+// leading tells whether this node leads its shard, whether or not it holds the lease right now
+func (n *Node) leading() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return !n.db.ReadOnly() || n.fenced
+}
+
+// Pulled records that replica is pulling our log, called when a pull comes in and when it is answered.
+func (n *Node) Pulled(replica string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pulls[replica] = time.Now()
+}
+
+// grantLease gives a new leader a whole lease before it counts on its replicas
+func (n *Node) grantLease() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.fenced = false
+	for _, addr := range n.dir.Candidates(n.shard) {
+		n.pulls[addr] = time.Now()
+	}
+}
+
+// checkLease stops taking writes once we and the replicas that pulled within a lease are no majority
+// of the shard anymore, a replica may take over then, and takes them again once enough replicas are back
+func (n *Node) checkLease() {
+	var replicas []string
+	for _, addr := range n.dir.Candidates(n.shard) {
+		if addr != n.opts.Self {
+			replicas = append(replicas, addr)
+		}
+	}
+	if len(replicas) == 0 {
+		// nobody could take over
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.db.ReadOnly() && !n.fenced {
+		// we just stepped down
+		return
+	}
+	heard := 0
+	for _, addr := range replicas {
+		if time.Since(n.pulls[addr]) < n.opts.LeaseTimeout {
+			heard++
+		}
+	}
+	held := heard >= (len(replicas)+1)/2
+	if held == !n.fenced {
+		return
+	}
+	n.fenced = !held
+	n.db.SetReadOnly(n.fenced)
+	if n.fenced {
+		log.Printf("Failover: %s heard from %d of %d replicas within %s, no more writes until enough are back", n.opts.Self, heard, len(replicas), n.opts.LeaseTimeout)
+	} else {
+		log.Printf("Failover: %s hears from %d of %d replicas again, taking writes", n.opts.Self, heard, len(replicas))
+	}
+}
+
+func (n *Node) adoptTerm(term uint64) {
+	if err := n.db.SetTerm(term); err != nil {
+		log.Printf("Failover: recording term %d failed: %v", term, err)
+		return
+	}
+	n.mu.Lock()
+	if term > n.term {
+		n.term = term
+	}
+	n.mu.Unlock()
+	n.dir.Observe(n.shard, n.dir.Leader(n.shard), term)
+}
+
+func (n *Node) startReplication(leader string) error {
+	c, err := replication.NewClient(n.db, leader, n.opts.Replication)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.client = c
+	n.mu.Unlock()
+	if n.opts.OnReplicationClient != nil {
+		n.opts.OnReplicationClient(c)
+	}
+
+	go c.Run()
+	return nil
+}
+
+func (n *Node) stopReplication() {
+	n.mu.Lock()
+	c := n.client
+	n.client = nil
+	n.mu.Unlock()
+
+	if c == nil {
+		return
+	}
+	c.Stop()
+	if n.opts.OnReplicationClient != nil {
+		n.opts.OnReplicationClient(nil)
+	}
+}
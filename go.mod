@@ -1,6 +1,6 @@
 module kv
 
-go 1.23
+go 1.23.0
 
 toolchain go1.23.11
 
@@ -8,11 +8,16 @@ require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/stretchr/testify v1.10.0
 	go.etcd.io/bbolt v1.4.2
+	golang.org/x/net v0.40.0
+	google.golang.org/grpc v1.74.2
+	google.golang.org/protobuf v1.36.6
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.25.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250528174236-200df99c418a // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,368 @@
+package membership
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kv/config"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SWIM style failure detection among every leader and replica listed in the config
+//
+// every ProbeInterval a node pings the next member in a shuffled round-robin order
+//   - a ping is a gossip exchange: both sides send their whole member list and merge the other one
+//   - if the target does not answer, IndirectProbes other members are asked to ping it for us
+//   - if none of them reaches it either, it becomes suspect, and dead once it stayed suspect for SuspectTimeout
+//
+// every member has an incarnation number only it may raise, a member that hears it is suspected or dead
+// raises it and gossips itself alive again, which overrides the older rumour
+// dead members are not probed anymore, they come back by pinging the others themselves
+
+type Status string
+
+const (
+	Alive   Status = "alive"
+	Suspect Status = "suspect"
+	Dead    Status = "dead"
+)
+
+type Member struct {
+	Addr        string    `json:"addr"`
+	Status      Status    `json:"status"`
+	Incarnation uint64    `json:"incarnation"`
+	Since       time.Time `json:"since"` // when this node saw the status change
+}
+
+// Message is what members send each other on /cluster/gossip, the answer is one too.
+type Message struct {
+	From    string   `json:"from"`
+	Members []Member `json:"members"`
+}
+
+const (
+	DefaultProbeInterval  = time.Second
+	DefaultProbeTimeout   = 500 * time.Millisecond
+	DefaultIndirectProbes = 3
+	DefaultSuspectTimeout = 5 * time.Second
+)
+
+type Options struct {
+	Self string // our own address, as listed in the config
+
+	ProbeInterval  time.Duration // how often a member is pinged, default 1s
+	ProbeTimeout   time.Duration // how long a ping may take, default 500ms
+	IndirectProbes int           // how many members are asked to ping a silent one, default 3
+	SuspectTimeout time.Duration // how long a suspect may refute before it is dead, default 5s
+}
+
+// List is this node's view of the health of every node of the cluster.
+type List struct {
+	opts       Options
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	members     map[string]*Member
+	incarnation uint64
+	order       []string // probe order, reshuffled after every round
+	next        int
+}
+
+func NewList(addrs []string, opts Options) (*List, error) {
+	if opts.Self == "" {
+		return nil, errors.New("empty self address")
+	}
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = DefaultProbeInterval
+	}
+	if opts.ProbeTimeout == 0 {
+		opts.ProbeTimeout = DefaultProbeTimeout
+	}
+	if opts.IndirectProbes == 0 {
+		opts.IndirectProbes = DefaultIndirectProbes
+	}
+	if opts.SuspectTimeout == 0 {
+		opts.SuspectTimeout = DefaultSuspectTimeout
+	}
+	if opts.ProbeInterval < 0 || opts.ProbeTimeout < 0 || opts.IndirectProbes < 0 || opts.SuspectTimeout < 0 {
+		return nil, fmt.Errorf("negative membership option in %+v", opts)
+	}
+
+	l := &List{
+		opts:       opts,
+		httpClient: &http.Client{Timeout: opts.ProbeTimeout},
+		members:    make(map[string]*Member),
+	}
+	l.SetAddrs(addrs)
+	return l, nil
+}
+
+// Addrs returns the address of every leader and replica in shards.
+func Addrs(shards *config.Shards) []string {
+	var res []string
+	for idx, addr := range shards.Addrs {
+		res = append(res, addr)
+		res = append(res, shards.Replicas[idx]...)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// SetAddrs switches to a new set of nodes, e.g. after a config reload.
+// Nodes that are still there keep their status, new ones start out alive.
+func (l *List) SetAddrs(addrs []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	keep := map[string]bool{l.opts.Self: true}
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+	for addr := range keep {
+		if _, ok := l.members[addr]; !ok {
+			l.members[addr] = &Member{Addr: addr, Status: Alive, Since: now}
+		}
+	}
+	for addr := range l.members {
+		if !keep[addr] {
+			delete(l.members, addr)
+		}
+	}
+	l.order = nil
+}
+
+// Members returns every member sorted by address, ourselves included.
+func (l *List) Members() []Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.snapshot()
+}
+
+func (l *List) snapshot() []Member {
+	res := make([]Member, 0, len(l.members))
+	for _, m := range l.members {
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res
+}
+
+// Status returns what this node believes about addr, nodes it does not track count as alive.
+func (l *List) Status(addr string) Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if m, ok := l.members[addr]; ok {
+		return m.Status
+	}
+	return Alive
+}
+
+// Known tells whether addr is one of the members, ourselves included.
+func (l *List) Known(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.members[addr]
+	return ok
+}
+
+// Alive tells whether addr may be sent requests, i.e. it is not known to be dead.
+// A suspect still counts, it may only be slow.
+func (l *List) Alive(addr string) bool {
+	return l.Status(addr) != Dead
+}
+
+// Gossip merges the member list of another node and returns ours, it serves /cluster/gossip.
+func (l *List) Gossip(msg Message) Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.merge(msg.Members)
+	return Message{From: l.opts.Self, Members: l.snapshot()}
+}
+
+func (l *List) merge(members []Member) {
+	for _, m := range members {
+		if m.Addr == l.opts.Self {
+			if m.Status != Alive && m.Incarnation >= l.incarnation {
+				// refute, the next exchange spreads the new incarnation
+				l.incarnation = m.Incarnation + 1
+				self := l.members[l.opts.Self]
+				self.Incarnation = l.incarnation
+				log.Printf("Membership: %s is rumoured %s, refuting with incarnation %d", l.opts.Self, m.Status, l.incarnation)
+			}
+			continue
+		}
+		cur, ok := l.members[m.Addr]
+		if !ok || !overrides(m, *cur) {
+			continue
+		}
+		l.setStatus(cur, m.Status, m.Incarnation)
+	}
+}
+
+// overrides tells whether what m says about a member is newer than cur
+func overrides(m, cur Member) bool {
+	switch m.Status {
+	case Alive:
+		return m.Incarnation > cur.Incarnation
+	case Suspect:
+		return m.Incarnation > cur.Incarnation || (m.Incarnation == cur.Incarnation && cur.Status == Alive)
+	case Dead:
+		return m.Incarnation > cur.Incarnation || (m.Incarnation == cur.Incarnation && cur.Status != Dead)
+	}
+	return false
+}
+
+func (l *List) setStatus(m *Member, status Status, incarnation uint64) {
+	if m.Status != status {
+		log.Printf("Membership: %s is %s (incarnation %d)", m.Addr, status, incarnation)
+		m.Since = time.Now()
+	}
+	m.Status = status
+	m.Incarnation = incarnation
+}
+
+// Run probes a member every ProbeInterval until ctx is done.
+func (l *List) Run(ctx context.Context) {
+	t := time.NewTicker(l.opts.ProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		l.round(ctx)
+	}
+}
+
+// round expires suspects and probes the next member
+func (l *List) round(ctx context.Context) {
+	target, inc, ok := l.nextTarget()
+	if !ok {
+		return
+	}
+	if l.Ping(ctx, target) == nil || l.pingIndirectly(ctx, target) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if m, ok := l.members[target]; ok && m.Status == Alive && m.Incarnation == inc {
+		l.setStatus(m, Suspect, inc)
+	}
+}
+
+// nextTarget expires suspects and returns the next member to probe
+func (l *List) nextTarget() (addr string, incarnation uint64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range l.members {
+		if m.Status == Suspect && time.Since(m.Since) >= l.opts.SuspectTimeout {
+			l.setStatus(m, Dead, m.Incarnation)
+		}
+	}
+
+	// at most one pass over the order, the members may have changed since it was shuffled
+	for i := 0; i <= len(l.order); i++ {
+		if l.next >= len(l.order) {
+			l.order = l.order[:0]
+			for addr := range l.members {
+				l.order = append(l.order, addr)
+			}
+			rand.Shuffle(len(l.order), func(i, j int) { l.order[i], l.order[j] = l.order[j], l.order[i] })
+			l.next = 0
+		}
+		addr := l.order[l.next]
+		l.next++
+		if m, ok := l.members[addr]; ok && addr != l.opts.Self && m.Status != Dead {
+			return addr, m.Incarnation, true
+		}
+	}
+	return "", 0, false
+}
+
+// Ping exchanges member lists with addr, it serves /cluster/ping-req too.
+func (l *List) Ping(ctx context.Context, addr string) error {
+	body, err := json.Marshal(l.Gossip(Message{}))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+"/cluster/gossip", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", addr, resp.StatusCode)
+	}
+	var msg Message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return fmt.Errorf("decoding members of %s: %w", addr, err)
+	}
+	l.Gossip(msg)
+	return nil
+}
+
+// pingIndirectly asks other members to ping target and tells whether any of them reached it
+func (l *List) pingIndirectly(ctx context.Context, target string) bool {
+	var helpers []string
+	for _, m := range l.Members() {
+		if m.Addr != l.opts.Self && m.Addr != target && m.Status == Alive {
+			helpers = append(helpers, m.Addr)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > l.opts.IndirectProbes {
+		helpers = helpers[:l.opts.IndirectProbes]
+	}
+	if len(helpers) == 0 {
+		return false
+	}
+
+	// the helpers ping with their own timeout, give them time for it
+	ctx, cancel := context.WithTimeout(ctx, 2*l.opts.ProbeTimeout)
+	defer cancel()
+	hc := &http.Client{Timeout: 2 * l.opts.ProbeTimeout}
+
+	reached := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func() {
+			u := "http://" + helper + "/cluster/ping-req?target=" + url.QueryEscape(target)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				reached <- false
+				return
+			}
+			resp, err := hc.Do(req)
+			if err != nil {
+				reached <- false
+				return
+			}
+			resp.Body.Close()
+			reached <- resp.StatusCode == http.StatusOK
+		}()
+	}
+	for range helpers {
+		if <-reached {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package membership
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// node serves the gossip endpoints of the list *l points to, addr is known once the server runs
+func node(t *testing.T, l **List) (*httptest.Server, string) {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cluster/gossip":
+			var msg Message
+			json.NewDecoder(r.Body).Decode(&msg)
+			json.NewEncoder(w).Encode((*l).Gossip(msg))
+		case "/cluster/ping-req":
+			if err := (*l).Ping(r.Context(), r.URL.Query().Get("target")); err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, strings.TrimPrefix(ts.URL, "http://")
+}
+
+func TestOverrides(t *testing.T) {
+	cur := Member{Status: Alive, Incarnation: 2}
+	require.False(t, overrides(Member{Status: Alive, Incarnation: 2}, cur))
+	require.True(t, overrides(Member{Status: Alive, Incarnation: 3}, cur))
+	require.True(t, overrides(Member{Status: Suspect, Incarnation: 2}, cur))
+	require.False(t, overrides(Member{Status: Suspect, Incarnation: 1}, cur))
+	require.True(t, overrides(Member{Status: Dead, Incarnation: 2}, cur))
+
+	// only the member itself clears a suspicion, by raising its incarnation
+	cur.Status = Suspect
+	require.False(t, overrides(Member{Status: Alive, Incarnation: 2}, cur))
+	require.True(t, overrides(Member{Status: Alive, Incarnation: 3}, cur))
+	require.False(t, overrides(Member{Status: Suspect, Incarnation: 2}, cur))
+
+	cur.Status = Dead
+	require.False(t, overrides(Member{Status: Suspect, Incarnation: 2}, cur))
+	require.False(t, overrides(Member{Status: Dead, Incarnation: 2}, cur))
+	require.True(t, overrides(Member{Status: Alive, Incarnation: 3}, cur))
+}
+
+func TestRefute(t *testing.T) {
+	l, err := NewList([]string{"127.0.0.2:8080", "127.0.0.3:8080"}, Options{Self: "127.0.0.2:8080"})
+	require.NoError(t, err)
+
+	reply := l.Gossip(Message{From: "127.0.0.3:8080", Members: []Member{
+		{Addr: "127.0.0.2:8080", Status: Dead, Incarnation: 4},
+		{Addr: "127.0.0.3:8080", Status: Alive, Incarnation: 1},
+		{Addr: "127.0.0.9:8080", Status: Alive}, // not in our config
+	}})
+	require.Equal(t, []Member{
+		{Addr: "127.0.0.2:8080", Status: Alive, Incarnation: 5},
+		{Addr: "127.0.0.3:8080", Status: Alive, Incarnation: 1},
+	}, stripSince(reply.Members))
+	require.Equal(t, Alive, l.Status("127.0.0.9:8080"), "unknown nodes are not judged")
+}
+
+func TestFailureDetection(t *testing.T) {
+	lists := make([]*List, 3)
+	servers := make([]*httptest.Server, 3)
+	addrs := make([]string, 3)
+	for i := range lists {
+		servers[i], addrs[i] = node(t, &lists[i])
+	}
+	for i := range lists {
+		var err error
+		lists[i], err = NewList(addrs, Options{
+			Self:           addrs[i],
+			ProbeInterval:  10 * time.Millisecond,
+			ProbeTimeout:   100 * time.Millisecond,
+			SuspectTimeout: 200 * time.Millisecond,
+		})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, l := range lists[:2] {
+		go l.Run(ctx)
+	}
+
+	// the third node goes away, both others agree that it is dead
+	servers[2].Close()
+	require.Eventually(t, func() bool {
+		return lists[0].Status(addrs[2]) == Dead && lists[1].Status(addrs[2]) == Dead
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, lists[0].Alive(addrs[1]))
+	require.False(t, lists[0].Alive(addrs[2]))
+
+	// a dead node drops out of the probe order, nobody suspects the live ones
+	time.Sleep(100 * time.Millisecond)
+	for _, m := range lists[0].Members() {
+		if m.Addr != addrs[2] {
+			require.Equal(t, Alive, m.Status, m.Addr)
+		}
+	}
+}
+
+func stripSince(members []Member) []Member {
+	for i := range members {
+		members[i].Since = time.Time{}
+	}
+	return members
+}
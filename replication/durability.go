@@ -0,0 +1,47 @@
+package replication
+
+import "fmt"
+
+// Durability is how many replicas have to ack a write before the leader answers the client.
+type Durability string
+
+const (
+	DurabilityAsync  Durability = "async"  // answer right away, replicas catch up on their own
+	DurabilityOne    Durability = "one"    // at least one replica has the write
+	DurabilityQuorum Durability = "quorum" // together with the leader a majority of the shard has the write
+	DurabilityAll    Durability = "all"    // every replica of the shard has the write
+)
+
+// ParseDurability checks that s names a durability level, "" means async.
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case "":
+		return DurabilityAsync, nil
+	case DurabilityAsync, DurabilityOne, DurabilityQuorum, DurabilityAll:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown durability %q, expected async, one, quorum or all", s)
+}
+
+// Required returns how many of the shard's replicas have to ack a write.
+// It fails if the shard does not have that many replicas, waiting would never succeed.
+func (d Durability) Required(replicas int) (int, error) {
+	var n int
+	switch d {
+	case DurabilityAsync, "":
+		return 0, nil
+	case DurabilityOne:
+		n = 1
+	case DurabilityQuorum:
+		// the leader is one of the replicas+1 copies, a majority needs (replicas+1)/2 more
+		n = (replicas + 1) / 2
+	case DurabilityAll:
+		n = replicas
+	default:
+		return 0, fmt.Errorf("unknown durability %q", string(d))
+	}
+	if n > replicas {
+		return 0, fmt.Errorf("durability %s needs %d replica acks but the shard has %d replicas", d, n, replicas)
+	}
+	return n, nil
+}
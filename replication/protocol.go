@@ -0,0 +1,77 @@
+package replication
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// the messages exchanged between a replica and its leader
+// every request carries the protocol version, every response echoes it back together with
+// a structured error, so a failure on the leader shows up as a code and a message on the replica
+// keys and values are []byte, encoding/json turns them into base64 so any bytes survive the trip
+
+// ProtocolVersion is bumped whenever the replication messages change incompatibly.
+// Version 1 was the unversioned format with string values and an error interface.
+const ProtocolVersion = 2
+
+// VersionParam is the query parameter a replica sends its protocol version in
+const VersionParam = "version"
+
+// SnapshotSeqHeader carries the replication position a snapshot corresponds to
+const SnapshotSeqHeader = "X-KV-Replication-Seq"
+
+// error codes of the replication protocol
+const (
+	ErrCodeUnsupportedVersion = "unsupported_version" // the two sides speak different protocol versions
+	ErrCodeBadRequest         = "bad_request"         // a parameter is missing or malformed
+	ErrCodeSeqAhead           = "seq_ahead"           // the replica acked a position the leader never wrote
+	ErrCodeSnapshotRequired   = "snapshot_required"   // the replica's position is not in the log, it has to bootstrap again
+	ErrCodeInternal           = "internal"            // the leader failed to read or write its database
+)
+
+// Error is a failure reported by the leader.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NextKeyValue is a single log entry.
+// Deleted marks a tombstone, the replica removes the key instead of setting it and Value is empty.
+type NextKeyValue struct {
+	Seq     uint64 `json:"seq"`
+	Key     []byte `json:"key"`
+	Value   []byte `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// NextKeyValues is the response to /next-replication-key, a batch of log entries in commit order.
+// Entries is empty when the replica is caught up.
+type NextKeyValues struct {
+	Version int            `json:"version"`
+	Entries []NextKeyValue `json:"entries"`
+	Error   *Error         `json:"error,omitempty"`
+}
+
+// AckResponse is the response to /delete-replication-key.
+type AckResponse struct {
+	Version int    `json:"version"`
+	Error   *Error `json:"error,omitempty"`
+}
+
+// CheckVersion validates the protocol version a replica sent.
+func CheckVersion(v string) *Error {
+	if v == strconv.Itoa(ProtocolVersion) {
+		return nil
+	}
+	if v == "" {
+		v = "1"
+	}
+	return &Error{
+		Code:    ErrCodeUnsupportedVersion,
+		Message: fmt.Sprintf("replica speaks protocol version %s, leader speaks %d", v, ProtocolVersion),
+	}
+}
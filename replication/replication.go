@@ -1,15 +1,17 @@
 package replication
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"kv/db"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,124 +20,452 @@ import (
 // increase availability or fault tolerance
 // eventually consistent
 // contacts the leader/master server
-// requests the next key-value pair from replication queue
-// apply it to local db
-// inform the leader to remove the key from replication queue
+// requests the next entry after its last applied sequence number from the replication log
+// apply it to local db, together with the new sequence number
+// inform the leader that everything up to that sequence number can be dropped from the log
 
-// ClientLoop() continuously polls for updates from the leader
+// bootstrap() - on first start, installs a snapshot of the leader before tailing the log
+// Run() / ClientLoop() continuously pull updates from the leader, long-polling when Options.LongPollWait is set
+// Status() - what the replica knows about its own progress, served on /replication/status
 // loop() - executes one replication cycle
-// deleteFromReplicationQueue() - informs the leader to delete the replicated key
-// NextKeyValue - JSON struct for communication
+// deleteFromReplicationQueue() - informs the leader that the batch was applied
+// NextKeyValues, AckResponse - JSON structs for communication, see protocol.go
 
-// there is no batching here though, fetches one key at a time
-// need to add validation of response body
+// entries are fetched in batches of up to Options.BatchSize, applied in one bolt transaction and acked once
 // need auth for hitting the leader endpoint
 
-// if replica writes successfully, and but crashes before deleting key, on next startup key is still in the queue
+// if replica writes successfully, and but crashes before acking, on next startup it asks for entries after
+// its persisted sequence number, so the entry is not applied twice, the ack just happens later
 
 // there is a single point of failure with hardCoded single leader, no leader selection implemented
 // essentially fetch next and ack delete
 
-type NextKeyValue struct {
-	Key   string
-	Value string
-	Err   error
+// DefaultBatchSize is used when Options.BatchSize is not set
+const DefaultBatchSize = 100
+
+// MaxBatchSize caps how many entries the leader hands out per pull
+const MaxBatchSize = 10000
+
+// MaxLongPollWait caps how long the leader holds a pull open waiting for new entries
+const MaxLongPollWait = time.Minute
+
+const (
+	pollInterval     = 100 * time.Millisecond // how often to ask when not long-polling
+	longPollFallback = 30 * time.Second       // how long to stick to plain polling after a failed long-poll
+)
+
+type Options struct {
+	ReplicaID string // the leader keeps a separate acked position per replica id
+	BatchSize int    // max number of log entries per pull
+
+	// LongPollWait is how long the leader may hold a pull open until new entries show up,
+	// so a write reaches the replica as soon as it commits. 0 means plain polling.
+	LongPollWait time.Duration
 }
 
-type client struct {
+// Client pulls the replication log of a single leader into the local database.
+type Client struct {
 	db         *db.Database
 	leaderAddr string
+	opts       Options
+	httpClient *http.Client
+
+	// when a long-poll fails we poll plainly until this time, then try long-polling again
+	pollUntil time.Time
+
+	// Stop cancels ctx, Run closes done on its way out
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started atomic.Bool
+	done    chan struct{}
+
+	mu     sync.Mutex
+	status ClientStatus
+}
+
+// ClientStatus is the replica side of /replication/status.
+// CaughtUpAt is the last time the replica is sure to have had everything the leader had, the time the last pull
+// that drained the leader's log was sent.
+type ClientStatus struct {
+	ReplicaID         string    `json:"replica_id"`
+	Leader            string    `json:"leader"`
+	LastAppliedSeq    uint64    `json:"last_applied_seq"`
+	LastAppliedAt     time.Time `json:"last_applied_at"`
+	CaughtUpAt        time.Time `json:"caught_up_at"`
+	LastContactAt     time.Time `json:"last_contact_at"`
+	ConsecutiveErrors int       `json:"consecutive_errors"`
+	LastError         string    `json:"last_error,omitempty"`
 }
 
-func ClientLoop(db *db.Database, leaderAddr string) {
+// Status is the body of /replication/status, Leader is set on leaders and Replica on replicas.
+type Status struct {
+	Role    string        `json:"role"`
+	Leader  *LeaderStatus `json:"leader,omitempty"`
+	Replica *ClientStatus `json:"replica,omitempty"`
+}
+
+// LeaderStatus describes the replication log of a leader.
+// QueueDepth is how many writes the furthest behind registered replica has not acked, 0 with no replica.
+type LeaderStatus struct {
+	LastSeq    uint64                     `json:"last_seq"`
+	QueueDepth int                        `json:"queue_depth"`
+	Replicas   map[string]ReplicaPosition `json:"replicas"`
+}
+
+// ReplicaPosition is how far a registered replica got, Lag counts entries it has not acked yet.
+type ReplicaPosition struct {
+	AckedSeq uint64 `json:"acked_seq"`
+	Lag      uint64 `json:"lag"`
+}
+
+// NewClient validates the options and returns a client ready to Run.
+func NewClient(db *db.Database, leaderAddr string, opts Options) (*Client, error) {
 	if db == nil {
-		log.Fatalf("replication.ClientLoop: nil database passed for leader %s", leaderAddr)
+		return nil, fmt.Errorf("nil database passed for leader %s", leaderAddr)
 	}
 	if leaderAddr == "" {
-		log.Fatalf("replication.ClientLoop: empty leader address")
+		return nil, errors.New("empty leader address")
+	}
+	if opts.ReplicaID == "" {
+		return nil, errors.New("empty replica id")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.BatchSize > MaxBatchSize {
+		return nil, fmt.Errorf("batch size %d is above the maximum of %d", opts.BatchSize, MaxBatchSize)
+	}
+	if opts.LongPollWait < 0 || opts.LongPollWait > MaxLongPollWait {
+		return nil, fmt.Errorf("long-poll wait %s must be between 0 and %s", opts.LongPollWait, MaxLongPollWait)
 	}
 
-	c := &client{db: db, leaderAddr: leaderAddr}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Client{
+		db:         db,
+		leaderAddr: leaderAddr,
+		opts:       opts,
+		// give the leader the whole long-poll wait plus some slack before giving up on it
+		httpClient: &http.Client{Timeout: opts.LongPollWait + 10*time.Second},
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		status:     ClientStatus{ReplicaID: opts.ReplicaID, Leader: leaderAddr},
+	}, nil
+}
+
+func ClientLoop(db *db.Database, leaderAddr string, opts Options) {
+	c, err := NewClient(db, leaderAddr, opts)
+	if err != nil {
+		log.Fatalf("replication.ClientLoop: %v", err)
+	}
+	c.Run()
+}
+
+// Run replicates until Stop is called.
+func (c *Client) Run() {
+	c.started.Store(true)
+	defer close(c.done)
+
 	for {
-		present, err := c.loop()
+		// a fresh replica would only see what is still in the leader's log, so copy everything first
+		// once the replica has data this does nothing
+		if err := c.bootstrap(); err != nil {
+			c.recordResult(err)
+			log.Printf("Bootstrap error: %v", err)
+			if !c.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+
+		start := time.Now()
+		wait := c.longPollWait()
+		n, sent, err := c.loop(wait)
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.recordResult(err)
+
+		// a short batch means the leader had nothing more when it answered, which was after the pull was sent
+		// an empty long-poll was held the whole wait, so the leader had nothing more until the wait ran out
+		if err == nil && n < c.opts.BatchSize {
+			caughtUp := sent
+			if n == 0 && wait > 0 && time.Since(sent) >= wait {
+				caughtUp = sent.Add(wait)
+			}
+			c.mu.Lock()
+			c.status.CaughtUpAt = caughtUp
+			c.mu.Unlock()
+		}
+
+		var replErr *Error
+		if errors.As(err, &replErr) && replErr.Code == ErrCodeSnapshotRequired {
+			log.Printf("Leader %s can't serve our position from its log, bootstrapping again: %v", c.leaderAddr, err)
+			if err := c.db.ResetReplicationState(); err != nil {
+				log.Printf("Failed to reset replication state: %v", err)
+				c.sleep(time.Second)
+			}
+			continue
+		}
+
 		if err != nil {
 			log.Printf("Loop error: %v", err)
-			time.Sleep(time.Second)
+			if wait > 0 {
+				log.Printf("Long-poll to %s failed, falling back to polling for %s", c.leaderAddr, longPollFallback)
+				c.pollUntil = time.Now().Add(longPollFallback)
+			}
+			if !c.sleep(time.Second) {
+				return
+			}
 			continue
 		}
 
-		if !present {
-			time.Sleep(time.Millisecond * 100)
+		// also covers a leader that does not know about long-polling and answers right away
+		if elapsed := time.Since(start); n == 0 && elapsed < pollInterval {
+			if !c.sleep(pollInterval - elapsed) {
+				return
+			}
+		}
+	}
+}
+
+// Stop makes Run return and waits for it, nothing is applied to the database after Stop returns.
+func (c *Client) Stop() {
+	c.cancel()
+	if c.started.Load() {
+		<-c.done
+	}
+}
+
+// sleep waits for d, it returns false if the client was stopped in the meantime
+func (c *Client) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// get issues a GET to the leader that is aborted when the client is stopped
+func (c *Client) get(hc *http.Client, path string, u url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, "http://"+c.leaderAddr+path+"?"+u.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return hc.Do(req)
+}
+
+// Status returns a copy of the replica's view of its replication progress.
+func (c *Client) Status() ClientStatus {
+	// the persisted position is the source of truth, it survives restarts
+	seq, err := c.db.LastAppliedSeq()
+
+	c.mu.Lock()
+	st := c.status
+	c.mu.Unlock()
+
+	if err == nil {
+		st.LastAppliedSeq = seq
+	}
+	return st
+}
+
+// Staleness bounds how far the replica's data may be behind the leader's, the time since CaughtUpAt.
+// A long-poll that is held open does not count, the leader may be gone or cut off without us knowing,
+// so with nothing to replicate the staleness goes up to the long-poll wait before every answer.
+// ok is false until the replica caught up for the first time.
+func (c *Client) Staleness() (staleness time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status.CaughtUpAt.IsZero() {
+		return 0, false
+	}
+	return time.Since(c.status.CaughtUpAt), true
+}
+
+// recordResult keeps the consecutive error count, a successful round trip resets it
+func (c *Client) recordResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.status.ConsecutiveErrors++
+		c.status.LastError = err.Error()
+		return
+	}
+	c.status.ConsecutiveErrors = 0
+	c.status.LastError = ""
+	c.status.LastContactAt = time.Now()
+}
+
+// bootstrap installs a snapshot of the leader, unless this replica already has data from it
+func (c *Client) bootstrap() error {
+	ok, err := c.db.IsBootstrapped()
+	if err != nil || ok {
+		return err
+	}
+
+	u := url.Values{}
+	u.Set(VersionParam, strconv.Itoa(ProtocolVersion))
+	u.Set("replica", c.opts.ReplicaID)
+
+	// no timeout here, a large database takes as long as it takes
+	resp, err := c.get(http.DefaultClient, "/replication/snapshot", u)
+	if err != nil {
+		return fmt.Errorf("failed to fetch snapshot from leader %s: %w", c.leaderAddr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var res AckResponse
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil || res.Error == nil {
+			return fmt.Errorf("leader %s refused snapshot with status %d", c.leaderAddr, resp.StatusCode)
 		}
+		return fmt.Errorf("leader %s refused snapshot: %w", c.leaderAddr, res.Error)
+	}
+
+	seq, err := strconv.ParseUint(resp.Header.Get(SnapshotSeqHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("snapshot from leader %s has no valid %s header: %w", c.leaderAddr, SnapshotSeqHeader, err)
 	}
+
+	if err := c.db.InstallSnapshot(resp.Body, seq); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+
+	log.Printf("Installed snapshot from leader %s at seq %d", c.leaderAddr, seq)
+	return nil
 }
 
-func (c *client) loop() (present bool, err error) {
+// longPollWait returns how long the leader may hold the next pull open, 0 while falling back to polling
+func (c *Client) longPollWait() time.Duration {
+	if time.Now().Before(c.pollUntil) {
+		return 0
+	}
+	return c.opts.LongPollWait
+}
+
+// loop pulls and applies one batch and returns how many entries it had and when the pull that got them was sent
+func (c *Client) loop(wait time.Duration) (n int, sent time.Time, err error) {
 	const maxRetries = 10          // Retry up to 10 times before giving up
 	const retryDelay = time.Second // Wait 1s between retries
 
+	after, err := c.db.LastAppliedSeq()
+	if err != nil {
+		return 0, sent, fmt.Errorf("failed to read last applied seq: %w", err)
+	}
+
+	u := url.Values{}
+	u.Set(VersionParam, strconv.Itoa(ProtocolVersion))
+	u.Set("replica", c.opts.ReplicaID)
+	u.Set("after", strconv.FormatUint(after, 10))
+	u.Set("limit", strconv.Itoa(c.opts.BatchSize))
+	if wait > 0 {
+		u.Set("wait", wait.String())
+	}
+
 	var resp *http.Response
 	for i := 0; i < maxRetries; i++ {
-		resp, err = http.Get("http://" + c.leaderAddr + "/next-replication-key")
+		sent = time.Now()
+		resp, err = c.get(c.httpClient, "/next-replication-key", u)
+		if err != nil && c.ctx.Err() != nil {
+			return 0, sent, c.ctx.Err()
+		}
 		if err != nil {
 			log.Printf("Loop error: could not connect to leader at %s (attempt %d/%d): %v", c.leaderAddr, i+1, maxRetries, err)
-			time.Sleep(retryDelay)
+			if !c.sleep(retryDelay) {
+				return 0, sent, c.ctx.Err()
+			}
 			continue
 		}
 		break // connection succeeded
 	}
 	if err != nil {
-		return false, fmt.Errorf("replica failed to contact leader %s after %d retries: %w", c.leaderAddr, maxRetries, err)
+		return 0, sent, fmt.Errorf("replica failed to contact leader %s after %d retries: %w", c.leaderAddr, maxRetries, err)
 	}
 	defer resp.Body.Close()
 
-	var res NextKeyValue
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return false, fmt.Errorf("failed to decode response from leader: %w", err)
+	var res NextKeyValues
+	if err := decodeResponse(resp, &res.Version, &res.Error, &res); err != nil {
+		return 0, sent, fmt.Errorf("pulling from leader %s: %w", c.leaderAddr, err)
 	}
 
-	// Server might return an error inside response (e.g., no more keys to replicate)
-	if res.Err != nil {
-		return false, fmt.Errorf("server-side error during replication: %v", res.Err)
+	if len(res.Entries) == 0 {
+		// Nothing to replicate currently
+		return 0, sent, nil
 	}
 
-	if res.Key == "" {
-		// Nothing to replicate currently
-		return false, nil
+	entries := make([]db.LogEntry, 0, len(res.Entries))
+	for _, kv := range res.Entries {
+		e := db.LogEntry{Seq: kv.Seq, Key: string(kv.Key), Deleted: kv.Deleted}
+		if !kv.Deleted {
+			// a stored empty value is still a value, not a missing one
+			e.Value = kv.Value
+			if e.Value == nil {
+				e.Value = []byte{}
+			}
+		}
+		entries = append(entries, e)
 	}
 
-	if err := c.db.SetKeyOnReplica(res.Key, []byte(res.Value)); err != nil {
-		return false, fmt.Errorf("failed to set key on replica: %w", err)
+	// a stopped client must not touch the database anymore, failover may have promoted it already
+	if c.ctx.Err() != nil {
+		return 0, sent, c.ctx.Err()
+	}
+	if err := c.db.ApplyReplicationBatch(entries); err != nil {
+		return 0, sent, fmt.Errorf("failed to apply seq %d-%d on replica: %w", entries[0].Seq, entries[len(entries)-1].Seq, err)
 	}
 
-	if err := c.deleteFromReplicationQueue(res.Key, res.Value); err != nil {
-		log.Printf("Warning: DeleteKeyFromReplication failed for key %q: %v", res.Key, err)
+	c.mu.Lock()
+	c.status.LastAppliedAt = time.Now()
+	c.mu.Unlock()
+
+	// one ack for the whole batch
+	last := entries[len(entries)-1].Seq
+	if err := c.deleteFromReplicationQueue(last); err != nil {
+		log.Printf("Warning: DeleteKeyFromReplication failed for seq %d: %v", last, err)
 	}
 
-	return true, nil
+	return len(entries), sent, nil
 }
 
-func (c *client) deleteFromReplicationQueue(key, value string) error {
+func (c *Client) deleteFromReplicationQueue(seq uint64) error {
 	u := url.Values{}
-	u.Set("key", key)
-	u.Set("value", value)
+	u.Set(VersionParam, strconv.Itoa(ProtocolVersion))
+	u.Set("replica", c.opts.ReplicaID)
+	u.Set("seq", strconv.FormatUint(seq, 10))
 
-	// log.Printf("Deleting key=%q, value=%q from replication queue on %q", key, value, c.leaderAddr)
+	// log.Printf("Acking seq=%d on %q", seq, c.leaderAddr)
 
-	resp, err := http.Get("http://" + c.leaderAddr + "/delete-replication-key?" + u.Encode())
+	resp, err := c.get(c.httpClient, "/delete-replication-key", u)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	result, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
+	var res AckResponse
+	return decodeResponse(resp, &res.Version, &res.Error, &res)
+}
 
-	if !bytes.Equal(result, []byte("ok")) {
-		return errors.New(string(result))
+// decodeResponse decodes a leader response into res and turns a non 200 status, a version mismatch
+// or a reported error into an error. version and respErr point into res.
+func decodeResponse(resp *http.Response, version *int, respErr **Error, res any) error {
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("failed to decode response with status %d: %w", resp.StatusCode, err)
+	}
+	if *respErr != nil {
+		return fmt.Errorf("leader answered %d: %w", resp.StatusCode, *respErr)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader answered %d without an error", resp.StatusCode)
+	}
+	if *version != ProtocolVersion {
+		return fmt.Errorf("leader speaks protocol version %d, replica speaks %d", *version, ProtocolVersion)
 	}
-
 	return nil
 }
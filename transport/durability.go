@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"kv/replication"
+	"time"
+)
+
+// SetDurability sets the durability writes get when the request does not ask for one,
+// and how long a write may wait for its replica acks. Must be called before serving.
+func (s *Server) SetDurability(d replication.Durability, timeout time.Duration) {
+	s.durability = d
+	s.durabilityTimeout = timeout
+}
+
+// shardReplicas returns the ids of the nodes replicating our shard.
+// Replicas register under their address, so these are the configured replicas,
+// with failover the former leader counts too and whoever leads right now does not.
+func (s *Server) shardReplicas() []string {
+	if s.failover == nil {
+		return s.topology().Replicas[s.topology().CurIdx]
+	}
+
+	var res []string
+	for _, addr := range s.failover.Directory().Candidates(s.topology().CurIdx) {
+		if addr != s.failover.Self() {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// durabilityLevel picks the durability for a request and checks the shard can satisfy it
+// before anything is written.
+func (s *Server) durabilityLevel(param string) (replication.Durability, int, error) {
+	d := s.durability
+	if param != "" {
+		var err error
+		if d, err = replication.ParseDurability(param); err != nil {
+			return "", 0, err
+		}
+	}
+	n, err := d.Required(len(s.shardReplicas()))
+	return d, n, err
+}
+
+// waitForDurability blocks until required replicas acked seq or the durability timeout passes.
+func (s *Server) waitForDurability(ctx context.Context, seq uint64, d replication.Durability, required int) error {
+	if required == 0 {
+		return nil
+	}
+	if s.durabilityTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.durabilityTimeout)
+		defer cancel()
+	}
+
+	acked, err := s.waitForAcks(ctx, seq, s.shardReplicas(), required)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("durability %s not reached: %d of %d required replicas acked seq %d before %v",
+			d, acked, required, seq, ctx.Err())
+	}
+	return err
+}
+
+// waitForAcks blocks until required of the replicas acked seq or ctx is done,
+// it returns how many had acked when it gave up.
+func (s *Server) waitForAcks(ctx context.Context, seq uint64, replicas []string, required int) (int, error) {
+	for {
+		// grab the channel before counting so an ack in between still wakes us up
+		changed := s.db.AcksChanged()
+		acked, err := s.db.AckedBy(seq, replicas)
+		if err != nil || acked >= required {
+			return acked, err
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return acked, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,694 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"kv/db"
+	"kv/kvpb"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// the gRPC service shares the node's address with HTTP, SplitListener tells the connections apart
+// Get, Set, Delete and the batches work on the database like their /v1/keys counterparts, and whatever
+// this node can't serve goes on over gRPC to the node that can, marked as forwarded with our address
+// and topology epoch. A forwarded call is passed on again only to the node that serves our own shard
+// Scan merges our pages with the keys the other shards' leaders stream
+// Watch follows the replication log of every shard's leader, the other leaders over gRPC streams
+// a forwarded Scan or Watch is for the shard of the node it reaches only
+
+// grpcForwardedKey marks a call another node passed on to us, grpcEpochKey carries its topology epoch
+const (
+	grpcForwardedKey = "x-kv-forwarded"
+	grpcEpochKey     = "x-kv-epoch"
+)
+
+// batchWorkers is how many keys of a batch are worked on at once
+const batchWorkers = 16
+
+// watchBatch is how many log entries a watch reads at once
+const watchBatch = 100
+
+// watchLeaderCheck is how often an idle watch makes sure this node still leads its shard
+const watchLeaderCheck = time.Second
+
+// splitTimeout is how long a new connection may take to show whether it speaks gRPC
+const splitTimeout = 10 * time.Second
+
+// SplitListener hands the connections of l that open with the HTTP/2 client preface, gRPC ones,
+// to grpcL and all others to httpL, so both can be served on one address. Closing either closes l.
+func SplitListener(l net.Listener) (grpcL, httpL net.Listener) {
+	sl := &splitListener{Listener: l, grpc: make(chan net.Conn), http: make(chan net.Conn), done: make(chan struct{})}
+	go sl.run()
+	return &sideListener{sl, sl.grpc}, &sideListener{sl, sl.http}
+}
+
+type splitListener struct {
+	net.Listener
+	grpc, http chan net.Conn
+	done       chan struct{} // closed once l stops accepting, err says why
+	err        error
+}
+
+func (sl *splitListener) run() {
+	defer close(sl.done)
+	for {
+		conn, err := sl.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			sl.err = err
+			return
+		}
+		if err != nil {
+			// out of file descriptors and such, like net/http keep going after a pause
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go sl.route(conn)
+	}
+}
+
+// route reads as much of the HTTP/2 preface as conn sends until it differs and passes conn on
+func (sl *splitListener) route(conn net.Conn) {
+	preface := []byte(http2.ClientPreface)
+	buf := make([]byte, 0, len(preface))
+	conn.SetReadDeadline(time.Now().Add(splitTimeout))
+	for len(buf) < len(preface) && bytes.HasPrefix(preface, buf) {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	side := sl.http
+	if bytes.Equal(buf, preface) {
+		side = sl.grpc
+	}
+	select {
+	case side <- &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf), conn)}:
+	case <-sl.done:
+		conn.Close()
+	}
+}
+
+// sideListener is one of the listeners a SplitListener returns
+type sideListener struct {
+	*splitListener
+	conns chan net.Conn
+}
+
+func (l *sideListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// prefixConn gives back the bytes read to route a connection before the rest
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+type grpcService struct {
+	kvpb.UnimplementedKVServer
+	s *Server
+
+	mu    sync.Mutex
+	peers map[string]*grpc.ClientConn // to the nodes calls are passed on to
+}
+
+// RegisterGRPC adds the KV service to g.
+// Must be called before serving.
+func (s *Server) RegisterGRPC(g *grpc.Server) {
+	s.grpc = &grpcService{s: s, peers: make(map[string]*grpc.ClientConn)}
+	kvpb.RegisterKVServer(g, s.grpc)
+}
+
+// forwarded tells whether another node passed the call on to us
+func (g *grpcService) forwarded(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	from := md.Get(grpcForwardedKey)
+	if len(from) == 0 {
+		return false
+	}
+	if epoch := md.Get(grpcEpochKey); len(epoch) > 0 {
+		g.s.observeEpoch(from[0], epoch[0], false)
+	}
+	return true
+}
+
+// callPeer passes a call on to addr, a call that was passed on already only goes to the node
+// that serves our own shard
+func (g *grpcService) callPeer(ctx context.Context, addr string, call func(context.Context, kvpb.KVClient) error) error {
+	if g.forwarded(ctx) && !g.s.servesOwnShard(addr) {
+		return status.Errorf(codes.Aborted, "%v: the call was passed on already, not passing it on to %q", ErrTopologyMismatch, addr)
+	}
+	conn, err := g.peer(addr)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(
+		grpcForwardedKey, g.s.self(),
+		grpcEpochKey, strconv.FormatUint(g.s.topology().Epoch, 10),
+	))
+	return call(ctx, kvpb.NewKVClient(conn))
+}
+
+// toLeader passes a call on to the leader of the shard, if it does not answer the shard is asked
+// who leads it now and the call tried once more
+func (g *grpcService) toLeader(ctx context.Context, shard int, call func(context.Context, kvpb.KVClient) error) error {
+	s := g.s
+	if shard != s.topology().CurIdx && g.forwarded(ctx) {
+		return status.Errorf(codes.Aborted, "%v: by topology epoch %d the call belongs to shard %d, the sender routed it here",
+			ErrTopologyMismatch, s.topology().Epoch, shard)
+	}
+	addr, err := s.liveLeader(shard)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	err = g.callPeer(ctx, addr, call)
+	if status.Code(err) == codes.Unavailable && s.failover != nil {
+		if newAddr := s.failover.Directory().Refresh(shard); newAddr != addr {
+			err = g.callPeer(ctx, newAddr, call)
+		}
+	}
+	return err
+}
+
+func (g *grpcService) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	s := g.s
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty key")
+	}
+	var res *kvpb.GetResponse
+	remote := func(ctx context.Context, c kvpb.KVClient) (err error) {
+		res, err = c.Get(ctx, req)
+		return err
+	}
+	if parent := s.splitParent.Load(); parent != nil {
+		return res, g.callPeer(ctx, *parent, remote)
+	}
+
+	maxStaleness, err := s.readStaleness(req.MaxStaleness)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	shards := s.topology()
+	shard := shards.Index(req.Key)
+
+	// like GetKeyHandler, a node of the shard that is fresh enough serves the read itself
+	if shard != shards.CurIdx || !s.freshEnough(maxStaleness) {
+		if !g.forwarded(ctx) {
+			addr := s.nextReadNode(shard, maxStaleness)
+			if addr != s.self() && addr != s.leaderAddr(shard) {
+				err := g.callPeer(ctx, addr, remote)
+				if status.Code(err) != codes.Unavailable {
+					return res, err
+				}
+			}
+		}
+		return res, g.toLeader(ctx, shard, remote)
+	}
+
+	value, err := s.db.GetKey(req.Key)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "key %q not found", req.Key)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &kvpb.GetResponse{Value: value, Shard: int32(shard)}, nil
+}
+
+// write applies a write of key here with apply if we lead its shard and returns once it is as durable
+// as asked, otherwise it passes the write on with remote
+func (g *grpcService) write(ctx context.Context, key, durability string, apply func(*db.Database) (uint64, error), remote func(context.Context, kvpb.KVClient) error) error {
+	s := g.s
+	if key == "" {
+		return status.Error(codes.InvalidArgument, "empty key")
+	}
+	if parent := s.splitParent.Load(); parent != nil {
+		return g.callPeer(ctx, *parent, remote)
+	}
+
+	// routing and the write have to see the same topology, a cut-over waits for both
+	s.writeFence.RLock()
+	shards := s.topology()
+	shard := shards.Index(key)
+	if shard != shards.CurIdx || !s.isLocalLeader() {
+		s.writeFence.RUnlock()
+		if shard == shards.CurIdx && g.forwarded(ctx) {
+			// the sender took us for the leader, passing it on again could go round in circles
+			return status.Errorf(codes.Aborted, "%v: this node does not lead shard %d, %q does", db.ErrReadOnly, shard, s.leaderAddr(shard))
+		}
+		return g.toLeader(ctx, shard, remote)
+	}
+
+	d, required, err := s.durabilityLevel(durability)
+	if err != nil {
+		s.writeFence.RUnlock()
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	seq, err := apply(s.db)
+	s.writeFence.RUnlock()
+
+	switch {
+	case err == nil:
+		if err := s.waitForDurability(ctx, seq, d, required); err != nil {
+			// the write is on the leader and will still replicate, it is just not as durable as asked
+			return status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return nil
+	case errors.Is(err, db.ErrNotFound):
+		return status.Errorf(codes.NotFound, "key %q not found", key)
+	case errors.Is(err, db.ErrReadOnly):
+		return status.Errorf(codes.Aborted, "shard %d does not take writes on this node: %v", shard, err)
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (g *grpcService) Set(ctx context.Context, req *kvpb.SetRequest) (*kvpb.SetResponse, error) {
+	if int64(len(req.Value)) > g.s.maxValueSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "values are limited to %d bytes", g.s.maxValueSize)
+	}
+	var res *kvpb.SetResponse
+	err := g.write(ctx, req.Key, req.Durability, func(d *db.Database) (uint64, error) {
+		var existed bool
+		seq, err := d.SetKeyIf(req.Key, req.Value, func(cur []byte) bool {
+			existed = cur != nil
+			return true
+		})
+		res = &kvpb.SetResponse{Created: !existed}
+		return seq, err
+	}, func(ctx context.Context, c kvpb.KVClient) (err error) {
+		res, err = c.Set(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (g *grpcService) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	err := g.write(ctx, req.Key, req.Durability, func(d *db.Database) (uint64, error) {
+		var missing bool
+		seq, err := d.DeleteKeyIf(req.Key, func(cur []byte) bool {
+			missing = cur == nil
+			return !missing
+		})
+		if missing {
+			err = db.ErrNotFound
+		}
+		return seq, err
+	}, func(ctx context.Context, c kvpb.KVClient) error {
+		_, err := c.Delete(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &kvpb.DeleteResponse{}, nil
+}
+
+// each runs fn for 0 up to n, batchWorkers at a time
+func each(n int, fn func(i int)) {
+	sem := make(chan struct{}, batchWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+func (g *grpcService) BatchGet(ctx context.Context, req *kvpb.BatchGetRequest) (*kvpb.BatchGetResponse, error) {
+	results := make([]*kvpb.GetResult, len(req.Keys))
+	each(len(req.Keys), func(i int) {
+		key := req.Keys[i]
+		res, err := g.Get(ctx, &kvpb.GetRequest{Key: key, MaxStaleness: req.MaxStaleness})
+		switch {
+		case err == nil:
+			results[i] = &kvpb.GetResult{Key: key, Found: true, Value: res.Value}
+		case status.Code(err) == codes.NotFound:
+			results[i] = &kvpb.GetResult{Key: key}
+		default:
+			results[i] = &kvpb.GetResult{Key: key, Error: err.Error()}
+		}
+	})
+	return &kvpb.BatchGetResponse{Results: results}, nil
+}
+
+func (g *grpcService) BatchSet(ctx context.Context, req *kvpb.BatchSetRequest) (*kvpb.BatchSetResponse, error) {
+	results := make([]*kvpb.SetResult, len(req.Entries))
+	each(len(req.Entries), func(i int) {
+		e := req.Entries[i]
+		res, err := g.Set(ctx, &kvpb.SetRequest{Key: e.Key, Value: e.Value, Durability: req.Durability})
+		if err != nil {
+			results[i] = &kvpb.SetResult{Key: e.Key, Error: err.Error()}
+			return
+		}
+		results[i] = &kvpb.SetResult{Key: e.Key, Created: res.Created}
+	})
+	return &kvpb.BatchSetResponse{Results: results}, nil
+}
+
+// shardPages reads the keys of one shard, a page at a time from our database or as its leader streams them
+type shardPages struct {
+	shard   int
+	next    string // start of the next page
+	more    bool
+	entries []*kvpb.KeyValue
+	stream  kvpb.KV_ScanClient // nil when we read the shard ourselves
+}
+
+// openShard starts reading the keys of shard idx, here if our data is fresh enough
+// and from its leader or our split parent otherwise
+func (g *grpcService) openShard(ctx context.Context, idx int, req *kvpb.ScanRequest, maxStaleness time.Duration) (*shardPages, error) {
+	s := g.s
+	p := &shardPages{shard: idx, next: req.Start, more: true}
+	parent := s.splitParent.Load()
+	if idx == s.topology().CurIdx && parent == nil && s.freshEnough(maxStaleness) {
+		return p, nil
+	}
+
+	call := func(ctx context.Context, c kvpb.KVClient) (err error) {
+		p.stream, err = c.Scan(ctx, req)
+		if err == nil {
+			// the leader may be gone, better to know while another one can be asked
+			_, err = p.stream.Header()
+		}
+		return err
+	}
+	var err error
+	if idx == s.topology().CurIdx && parent != nil {
+		// the parent still has our keys
+		err = g.callPeer(ctx, *parent, call)
+	} else {
+		err = g.toLeader(ctx, idx, call)
+	}
+	return p, err
+}
+
+// fill reads the next page once the current one is used up
+func (p *shardPages) fill(g *grpcService, req *kvpb.ScanRequest) error {
+	if len(p.entries) > 0 || !p.more {
+		return nil
+	}
+	if p.stream != nil {
+		kv, err := p.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			p.more = false
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p.entries = append(p.entries, kv)
+		return nil
+	}
+
+	pageSize := DefaultScanLimit
+	if req.Limit > 0 && int(req.Limit) < pageSize {
+		pageSize = int(req.Limit)
+	}
+	// one more than asked tells whether there is another page, keys left over from a split are skipped
+	shards := g.s.topology()
+	kvs, err := g.s.db.Scan(p.next, req.End, pageSize+1, func(key string) bool { return shards.Index(key) == p.shard })
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	p.more = len(kvs) > pageSize
+	if p.more {
+		p.next = kvs[pageSize].Key
+		kvs = kvs[:pageSize]
+	}
+	for _, kv := range kvs {
+		p.entries = append(p.entries, &kvpb.KeyValue{Key: kv.Key, Value: kv.Value})
+	}
+	return nil
+}
+
+func (g *grpcService) Scan(req *kvpb.ScanRequest, stream kvpb.KV_ScanServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	maxStaleness, err := g.s.readStaleness(req.MaxStaleness)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	shards := g.s.topology()
+	var pages []*shardPages
+	for idx := 0; idx < shards.Count; idx++ {
+		if g.forwarded(ctx) && idx != shards.CurIdx {
+			// another node scans every shard, it asks us for ours only
+			continue
+		}
+		if shards.MayHold(idx, req.Start, req.End) {
+			p, err := g.openShard(ctx, idx, req, maxStaleness)
+			if err != nil {
+				return err
+			}
+			pages = append(pages, p)
+		}
+	}
+
+	var sent uint32
+	var last *string
+	for req.Limit == 0 || sent < req.Limit {
+		// the shard with the smallest key not sent yet
+		var head *shardPages
+		for _, p := range pages {
+			if err := p.fill(g, req); err != nil {
+				return err
+			}
+			if len(p.entries) > 0 && (head == nil || p.entries[0].Key < head.entries[0].Key) {
+				head = p
+			}
+		}
+		if head == nil {
+			return nil
+		}
+		kv := head.entries[0]
+		head.entries = head.entries[1:]
+		if last != nil && *last == kv.Key {
+			// during a split the new shard answers with its parent's keys, which the parent returns too
+			continue
+		}
+		last = &kv.Key
+		if err := stream.Send(kv); err != nil {
+			return err
+		}
+		sent++
+	}
+	return nil
+}
+
+func (g *grpcService) Watch(req *kvpb.WatchRequest, stream kvpb.KV_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	ready := func() { stream.SendHeader(metadata.MD{}) }
+
+	if g.forwarded(ctx) {
+		// another node watches every shard, it asks us for ours only
+		return g.watchLocal(ctx, req.Prefix, ready, stream.Send)
+	}
+
+	shards := g.s.topology()
+	readyc := make(chan struct{}, shards.Count)
+	errc := make(chan error, shards.Count)
+	events := make(chan *kvpb.WatchEvent)
+	for idx := 0; idx < shards.Count; idx++ {
+		go func() {
+			errc <- g.watchShard(ctx, idx, req.Prefix, func() { readyc <- struct{}{} }, func(ev *kvpb.WatchEvent) error {
+				select {
+				case events <- ev:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+
+	// the headers tell the caller that every shard is watched
+	for waiting := shards.Count; waiting > 0; {
+		select {
+		case <-readyc:
+			waiting--
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	ready()
+
+	for {
+		select {
+		case ev := <-events:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// watchShard follows the writes to shard idx, here if we lead it and through its leader otherwise
+func (g *grpcService) watchShard(ctx context.Context, idx int, prefix string, ready func(), send func(*kvpb.WatchEvent) error) error {
+	if idx == g.s.topology().CurIdx && g.s.isLocalLeader() {
+		return g.watchLocal(ctx, prefix, ready, send)
+	}
+
+	addr, err := g.s.liveLeader(idx)
+	if err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	var st kvpb.KV_WatchClient
+	err = g.callPeer(ctx, addr, func(ctx context.Context, c kvpb.KVClient) (err error) {
+		st, err = c.Watch(ctx, &kvpb.WatchRequest{Prefix: prefix})
+		if err == nil {
+			_, err = st.Header()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	ready()
+
+	for {
+		ev, err := st.Recv()
+		if errors.Is(err, io.EOF) {
+			return status.Errorf(codes.Unavailable, "the watch of shard %d on %q ended", idx, addr)
+		}
+		if err != nil {
+			return err
+		}
+		if err := send(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// watchLocal follows our replication log from its current end
+func (g *grpcService) watchLocal(ctx context.Context, prefix string, ready func(), send func(*kvpb.WatchEvent) error) error {
+	s := g.s
+	shard := s.topology().CurIdx
+	if !s.isLocalLeader() {
+		return status.Errorf(codes.Aborted, "this node does not lead shard %d", shard)
+	}
+	// the watch is no replica, hold the log so acks don't trim away what it has yet to send
+	// and hold all of it until we know where it starts
+	move, release := s.db.HoldLog(0)
+	defer release()
+	pos, err := s.db.LastLogSeq()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	move(pos)
+	ready()
+
+	for {
+		changed := s.db.LogChanged()
+		entries, err := s.db.GetReplicationBatch(pos, watchBatch)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if len(entries) > 0 && entries[0].Seq != pos+1 {
+			return status.Errorf(codes.DataLoss, "the replication log of shard %d was trimmed past the watch at %d", shard, pos)
+		}
+		for _, e := range entries {
+			pos = e.Seq
+			if !strings.HasPrefix(e.Key, prefix) {
+				continue
+			}
+			ev := &kvpb.WatchEvent{Type: kvpb.WatchEvent_SET, Key: e.Key, Value: e.Value, Shard: int32(shard), Seq: e.Seq}
+			if e.Deleted {
+				ev.Type = kvpb.WatchEvent_DELETE
+			}
+			if err := send(ev); err != nil {
+				return err
+			}
+		}
+		move(pos)
+		if len(entries) == watchBatch {
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(watchLeaderCheck):
+		case <-ctx.Done():
+			return nil
+		}
+		if !s.isLocalLeader() {
+			return status.Errorf(codes.Unavailable, "this node stopped leading shard %d", shard)
+		}
+	}
+}
+
+// peer returns a connection to the gRPC service of addr
+func (g *grpcService) peer(addr string) (*grpc.ClientConn, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if conn, ok := g.peers[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(int(g.s.maxValueSize)+1<<20)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	g.peers[addr] = conn
+	return conn, nil
+}
+
+// dropPeers closes the connections to nodes that are no longer in our layout,
+// a watch still streaming from one of them ends
+func (g *grpcService) dropPeers() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for addr, conn := range g.peers {
+		if !g.s.knownNode(addr) {
+			conn.Close()
+			delete(g.peers, addr)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"kv/db"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the v1 API has one resource per key
+//   GET    /v1/keys/{key}  the raw value, JSON with Accept: application/json, HEAD works too
+//   PUT    /v1/keys/{key}  the request body becomes the value, 201 if the key is new, 204 otherwise
+//   DELETE /v1/keys/{key}  204, or 404 if there was nothing to delete
+//   GET    /v1/keys?start=&end=&limit=  the keys of the asked node's shard in key order, one page at a time
+// values carry an ETag, writes take If-Match and If-None-Match against it and answer 412 when they fail,
+// except a create with If-None-Match: * of a key that exists, which is a 409
+// errors are JSON: 400 bad request, 404 missing key, 409 key exists, 412 failed precondition, 413 value too large,
+// 421 node not leading the shard or nodes disagreeing about the topology, 503 shard unavailable,
+// 504 not enough replica acks in time
+// max_staleness and durability are query parameters like on the old endpoints
+
+// DefaultMaxValueSize is the largest value a PUT may store.
+const DefaultMaxValueSize = 16 << 20
+
+// a scan page has DefaultScanLimit keys unless the request asks for another limit, at most MaxScanLimit
+const (
+	DefaultScanLimit = 1000
+	MaxScanLimit     = 10000
+)
+
+type keyResponse struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"` // base64 in JSON
+	Shard int    `json:"shard"`
+}
+
+type scanEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type scanResponse struct {
+	Shard   int         `json:"shard"`
+	Entries []scanEntry `json:"entries"`
+	Next    string      `json:"next,omitempty"` // start of the next page, "" after the last one
+}
+
+// errKeyExists fails a PUT with If-None-Match: * of a key that is already there
+var errKeyExists = errors.New("key exists")
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// SetMaxValueSize sets the largest value a PUT may store, must be called before serving.
+func (s *Server) SetMaxValueSize(n int64) {
+	s.maxValueSize = n
+}
+
+// GetKeyHandler serves GET and HEAD of /v1/keys/{key}.
+func (s *Server) GetKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	s.exchangeEpoch(w, r)
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("empty key"))
+		return
+	}
+	if parent := s.splitParent.Load(); parent != nil {
+		if err := s.proxyTo(*parent, w, r); err != nil {
+			writeError(w, forwardStatus(err, http.StatusServiceUnavailable), err)
+		}
+		return
+	}
+
+	maxStaleness, err := s.readStaleness(r.URL.Query().Get("max_staleness"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	shards := s.topology()
+	shard := shards.Index(key)
+
+	// a node of the shard that is fresh enough serves the read itself, any other passes it on,
+	// spread over the shard's nodes unless it is forwarded already and reached the node picked for it
+	if shard != shards.CurIdx || !s.freshEnough(maxStaleness) {
+		if !isForwarded(r) {
+			addr := s.nextReadNode(shard, maxStaleness)
+			if addr != s.self() && addr != s.leaderAddr(shard) && s.proxyTo(addr, w, r) == nil {
+				return
+			}
+		}
+		if err := s.toLeader(shard, w, r); err != nil {
+			writeError(w, forwardStatus(err, http.StatusServiceUnavailable), err)
+		}
+		return
+	}
+
+	value, err := s.db.GetKey(key)
+	if errors.Is(err, db.ErrNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("key %q not found", key))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tag := etag(value)
+	w.Header().Set("ETag", tag)
+	if matchesETag(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, keyResponse{Key: key, Value: value, Shard: shard})
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.Write(value)
+}
+
+// PutKeyHandler serves PUT of /v1/keys/{key}.
+func (s *Server) PutKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	s.exchangeEpoch(w, r)
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("empty key"))
+		return
+	}
+
+	// a value written on another node is streamed through
+	if s.forwardWrite(w, r, key) {
+		return
+	}
+
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxValueSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("values are limited to %d bytes", s.maxValueSize))
+			return
+		}
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// the layout may still change before the write, the value is forwarded from memory then
+	r.Body = io.NopCloser(bytes.NewReader(value))
+	r.ContentLength = int64(len(value))
+
+	var existed bool
+	check := preconditions(r)
+	createOnly := strings.TrimSpace(r.Header.Get("If-None-Match")) == "*"
+	s.writeKey(w, r, key, func(d *db.Database) (uint64, error) {
+		seq, err := d.SetKeyIf(key, value, func(cur []byte) bool {
+			existed = cur != nil
+			return check(cur)
+		})
+		if errors.Is(err, db.ErrConditionFailed) && existed && createOnly {
+			err = fmt.Errorf("%w: %w", errKeyExists, err)
+		}
+		return seq, err
+	}, func() {
+		w.Header().Set("ETag", etag(value))
+		if existed {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+}
+
+// DeleteKeyHandler serves DELETE of /v1/keys/{key}.
+func (s *Server) DeleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	s.exchangeEpoch(w, r)
+	if key == "" {
+		writeError(w, http.StatusBadRequest, errors.New("empty key"))
+		return
+	}
+
+	check := preconditions(r)
+	s.writeKey(w, r, key, func(d *db.Database) (uint64, error) {
+		var missing bool
+		seq, err := d.DeleteKeyIf(key, func(cur []byte) bool {
+			missing = cur == nil
+			return !missing && check(cur)
+		})
+		if missing {
+			err = db.ErrNotFound
+		}
+		return seq, err
+	}, func() {
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ScanHandler serves GET of /v1/keys, a page of the keys from start up to but not including end
+// that belong to the shard of the node asked, other shards have to be asked themselves.
+func (s *Server) ScanHandler(w http.ResponseWriter, r *http.Request) {
+	s.exchangeEpoch(w, r)
+	if parent := s.splitParent.Load(); parent != nil {
+		// the parent still has our keys, the client gets them from there
+		if err := s.proxyTo(*parent, w, r); err != nil {
+			writeError(w, forwardStatus(err, http.StatusServiceUnavailable), err)
+		}
+		return
+	}
+
+	q := r.URL.Query()
+	start, end := q.Get("start"), q.Get("end")
+	limit := DefaultScanLimit
+	if param := q.Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be a positive number, got %q", param))
+			return
+		}
+		limit = min(n, MaxScanLimit)
+	}
+	maxStaleness, err := s.readStaleness(q.Get("max_staleness"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	shards := s.topology()
+	if !s.freshEnough(maxStaleness) {
+		if err := s.toLeader(shards.CurIdx, w, r); err != nil {
+			writeError(w, forwardStatus(err, http.StatusServiceUnavailable), err)
+		}
+		return
+	}
+
+	// one more than asked tells whether there is another page, keys left over from a split are skipped
+	kvs, err := s.db.Scan(start, end, limit+1, func(key string) bool { return shards.Index(key) == shards.CurIdx })
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res := scanResponse{Shard: shards.CurIdx, Entries: make([]scanEntry, 0, len(kvs))}
+	if len(kvs) > limit {
+		res.Next = kvs[limit].Key
+		kvs = kvs[:limit]
+	}
+	for _, kv := range kvs {
+		res.Entries = append(res.Entries, scanEntry{Key: kv.Key, Value: kv.Value})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// forwardWrite passes a write of key on to the node that applies it, it returns false if that is us
+func (s *Server) forwardWrite(w http.ResponseWriter, r *http.Request, key string) bool {
+	if parent := s.splitParent.Load(); parent != nil {
+		if err := s.proxyTo(*parent, w, r); err != nil {
+			writeError(w, forwardStatus(err, http.StatusServiceUnavailable), err)
+		}
+		return true
+	}
+
+	shards := s.topology()
+	shard := shards.Index(key)
+	if shard == shards.CurIdx && s.isLocalLeader() {
+		return false
+	}
+	if shard == shards.CurIdx && isForwarded(r) {
+		// the sender took us for the leader, passing it on again could go round in circles
+		writeError(w, http.StatusMisdirectedRequest, fmt.Errorf("%w: this node does not lead shard %d, %q does", db.ErrReadOnly, shard, s.leaderAddr(shard)))
+		return true
+	}
+	if err := s.toLeader(shard, w, r); err != nil {
+		writeError(w, forwardStatus(err, http.StatusServiceUnavailable), err)
+	}
+	return true
+}
+
+// writeKey routes a write of key to the leader of its shard, or applies it here with write
+// and answers with done once it is as durable as asked
+func (s *Server) writeKey(w http.ResponseWriter, r *http.Request, key string, write func(*db.Database) (uint64, error), done func()) {
+	if s.forwardWrite(w, r, key) {
+		return
+	}
+
+	// routing and the write have to see the same topology, a cut-over waits for both
+	s.writeFence.RLock()
+	shards := s.topology()
+	shard := shards.Index(key)
+	if shard != shards.CurIdx || !s.isLocalLeader() {
+		// the layout or the leader changed in between
+		s.writeFence.RUnlock()
+		if !s.forwardWrite(w, r, key) {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("shard %d is changing hands, try again", shard))
+		}
+		return
+	}
+
+	d, required, err := s.durabilityLevel(r.URL.Query().Get("durability"))
+	if err != nil {
+		s.writeFence.RUnlock()
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	seq, err := write(s.db)
+	s.writeFence.RUnlock()
+
+	switch {
+	case err == nil:
+		err = s.waitForDurability(r.Context(), seq, d, required)
+		if err != nil {
+			// the write is on the leader and will still replicate, it is just not as durable as asked
+			writeError(w, http.StatusGatewayTimeout, err)
+			return
+		}
+		done()
+	case errors.Is(err, db.ErrNotFound):
+		writeError(w, http.StatusNotFound, fmt.Errorf("key %q not found", key))
+	case errors.Is(err, errKeyExists):
+		writeError(w, http.StatusConflict, fmt.Errorf("key %q: %w", key, err))
+	case errors.Is(err, db.ErrConditionFailed):
+		writeError(w, http.StatusPreconditionFailed, fmt.Errorf("key %q: %w", key, err))
+	case errors.Is(err, db.ErrReadOnly):
+		writeError(w, http.StatusMisdirectedRequest, fmt.Errorf("shard %d does not take writes on this node: %w", shard, err))
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// wantsJSON tells whether the client asked for the value wrapped in JSON
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// etag identifies a value, writes can make sure the value did not change since it was read
+func etag(value []byte) string {
+	h := fnv.New64a()
+	h.Write(value)
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// matchesETag tells whether an If-Match or If-None-Match header lists tag
+func matchesETag(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditions turns If-Match and If-None-Match into a check of the current value, nil if the key is missing
+func preconditions(r *http.Request) func(cur []byte) bool {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	return func(cur []byte) bool {
+		if ifMatch != "" && (cur == nil || !matchesETag(ifMatch, etag(cur))) {
+			return false
+		}
+		if ifNoneMatch != "" && cur != nil && matchesETag(ifNoneMatch, etag(cur)) {
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"kv/membership"
+	"net/http"
+)
+
+// SetMembership lets routing skip the nodes gossip found dead, must be called before serving.
+func (s *Server) SetMembership(l *membership.List) {
+	s.members = l
+}
+
+// alive tells whether addr may be sent requests, without membership every node may
+func (s *Server) alive(addr string) bool {
+	return s.members == nil || s.members.Alive(addr)
+}
+
+// MembersHandler returns the health of every node as this node sees it, as JSON.
+func (s *Server) MembersHandler(w http.ResponseWriter, r *http.Request) {
+	if s.members == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Error = membership is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.members.Members())
+}
+
+// GossipHandler merges the member list another node sends and answers with ours.
+func (s *Server) GossipHandler(w http.ResponseWriter, r *http.Request) {
+	if s.members == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Error = membership is not enabled")
+		return
+	}
+	var msg membership.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.members.Gossip(msg))
+}
+
+// PingReqHandler pings target on behalf of a node that could not reach it, 200 means it answered.
+// Only members are pinged, anyone may call this and we don't send requests wherever they point us.
+func (s *Server) PingReqHandler(w http.ResponseWriter, r *http.Request) {
+	if s.members == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Error = membership is not enabled")
+		return
+	}
+	r.ParseForm()
+	target := r.Form.Get("target")
+	if !s.members.Known(target) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %q is not a member", target)
+		return
+	}
+	err := s.members.Ping(r.Context(), target)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
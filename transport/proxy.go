@@ -0,0 +1,264 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// requests a node can not serve itself go through a reverse proxy to the node that can
+// method, headers, body and the answer's status, headers and body pass through as they are and are streamed,
+// over connections pooled per peer
+// in redirect mode a request for another shard is answered with a 307 to that shard's leader instead,
+// so a client can learn where keys live and go there directly, either way the answer names the leader
+// in X-KV-Shard-Owner
+
+// RoutingMode is what a node does with a request for a shard it does not lead.
+type RoutingMode string
+
+const (
+	RoutingProxy    RoutingMode = "proxy"    // pass it on and stream the answer back
+	RoutingRedirect RoutingMode = "redirect" // answer 307 Temporary Redirect to the leader
+)
+
+// routingHeader lets a request pick the routing mode for itself, "proxy" or "redirect"
+const routingHeader = "X-KV-Routing"
+
+// ownerHeader names the leader of the shard a misrouted request was meant for
+const ownerHeader = "X-KV-Shard-Owner"
+
+// ParseRoutingMode validates a routing mode, "" means proxy.
+func ParseRoutingMode(s string) (RoutingMode, error) {
+	switch m := RoutingMode(s); m {
+	case "":
+		return RoutingProxy, nil
+	case RoutingProxy, RoutingRedirect:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown routing mode %q, expected proxy or redirect", s)
+}
+
+// SetRoutingMode sets the routing mode of requests that do not pick one, must be called before serving.
+func (s *Server) SetRoutingMode(m RoutingMode) {
+	s.routing = m
+}
+
+// forwarded requests carry how often they were passed on and the sender's topology epoch
+// a node that gets a forwarded request for a shard it does not own does not pass it on again,
+// the sender and it route by different layouts and would bounce the request between each other,
+// it answers 421 Misdirected Request with a topology mismatch error instead
+//
+// a request is passed on maxHops times, from the node the client asked to a node of the request's shard
+// the one exception is a second hop inside that shard, to the node that serves it: a replica too stale
+// for a read hands it to its leader, a new shard hands everything to the parent that holds its keys until
+// the cut-over. Both only happen on the node the first hop picked, and end on a node that serves the
+// request or refuses it, so nothing goes round in circles. Anything else is refused with a 421.
+
+// hopsHeader counts how often a request was passed on from node to node
+const hopsHeader = "X-KV-Hops"
+
+const maxHops = 1
+
+// ErrTopologyMismatch means nodes disagree about where a request belongs.
+var ErrTopologyMismatch = errors.New("topology mismatch")
+
+// hops returns how often r was passed on already
+func hops(r *http.Request) int {
+	n, err := strconv.Atoi(r.Header.Get(hopsHeader))
+	if err == nil && n >= 0 {
+		return n
+	}
+	if isForwarded(r) {
+		// from a node that does not count hops
+		return 1
+	}
+	return 0
+}
+
+// topologyMismatch describes a request another node sent us for a shard we do not own
+func (s *Server) topologyMismatch(shard int, r *http.Request) error {
+	ours := s.topology().Epoch
+	theirs := r.Header.Get(epochHeader)
+	if theirs == "" {
+		theirs = "unknown"
+	}
+	err := fmt.Errorf("%w: node %q routed the request here by topology epoch %s, by epoch %d it belongs to shard %d",
+		ErrTopologyMismatch, r.Header.Get(forwardedHeader), theirs, ours, shard)
+	if theirs == strconv.FormatUint(ours, 10) {
+		err = fmt.Errorf("%w, the configs differ under the same epoch", err)
+	}
+	return err
+}
+
+// forwardStatus is the status to answer with when passing a request on failed with err,
+// unavailable unless the nodes disagree about the topology
+func forwardStatus(err error, unavailable int) int {
+	if errors.Is(err, ErrTopologyMismatch) {
+		return http.StatusMisdirectedRequest
+	}
+	return unavailable
+}
+
+// DefaultForwardTimeout is how long a forwarded request may wait for the peer to start answering.
+const DefaultForwardTimeout = 30 * time.Second
+
+// attemptKey carries the *proxyAttempt of a forwarded request through the proxy
+type attemptKey struct{}
+
+type proxyAttempt struct {
+	addr string
+	err  error // set if the peer never answered, nothing was written then
+}
+
+// SetForwardTimeout sets how long a forwarded request may wait for the peer to start answering,
+// must be called before serving.
+func (s *Server) SetForwardTimeout(d time.Duration) {
+	s.proxy.Transport.(*http.Transport).ResponseHeaderTimeout = d
+}
+
+func (s *Server) newProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			a := pr.In.Context().Value(attemptKey{}).(*proxyAttempt)
+			pr.SetURL(&url.URL{Scheme: "http", Host: a.addr})
+			pr.Out.Header.Set(forwardedHeader, s.self())
+			pr.Out.Header.Set(epochHeader, strconv.FormatUint(s.topology().Epoch, 10))
+			pr.Out.Header.Set(hopsHeader, strconv.Itoa(hops(pr.In)+1))
+		},
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConnsPerHost:   64,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: DefaultForwardTimeout,
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			s.observeEpoch(resp.Request.URL.Host, resp.Header.Get(epochHeader), true)
+			// the client keeps seeing the epoch of the node it asked
+			resp.Header.Del(epochHeader)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			r.Context().Value(attemptKey{}).(*proxyAttempt).err = err
+		},
+	}
+}
+
+// proxyTo passes the request on to addr and streams the answer back,
+// an error means addr did not answer and nothing was written to w
+func (s *Server) proxyTo(addr string, w http.ResponseWriter, r *http.Request) error {
+	if n := hops(r); n > maxHops || n == maxHops && !s.servesOwnShard(addr) {
+		return fmt.Errorf("%w: the request was passed on %d times already, not passing it on to %q", ErrTopologyMismatch, n, addr)
+	}
+	a := &proxyAttempt{addr: addr}
+	s.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), attemptKey{}, a)))
+	if a.err != nil {
+		return fmt.Errorf("forwarding to %q: %w", addr, a.err)
+	}
+	return nil
+}
+
+// servesOwnShard tells whether addr serves our own shard for us, it is its leader
+// or the parent we copy our keys from until the cut-over
+func (s *Server) servesOwnShard(addr string) bool {
+	if parent := s.splitParent.Load(); parent != nil {
+		return *parent == addr
+	}
+	return s.leaderAddr(s.topology().CurIdx) == addr
+}
+
+// toLeader hands the request to the leader of the shard, by proxy or by redirect,
+// an error means the shard is unavailable or the request came the wrong way, nothing was written to w then
+func (s *Server) toLeader(shard int, w http.ResponseWriter, r *http.Request) error {
+	if shard != s.topology().CurIdx && hops(r) > 0 {
+		return s.topologyMismatch(shard, r)
+	}
+	// a node that passed the request on proxies, it does not follow redirects
+	if isForwarded(r) || s.routingMode(r) != RoutingRedirect {
+		return s.proxyToLeader(shard, w, r)
+	}
+
+	addr, err := s.liveLeader(shard)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(ownerHeader, addr)
+	w.Header().Set("Location", "http://"+addr+r.RequestURI)
+	w.WriteHeader(http.StatusTemporaryRedirect)
+	return nil
+}
+
+// routingMode returns the mode the request asks for, or the node's if it asks for none it knows
+func (s *Server) routingMode(r *http.Request) RoutingMode {
+	switch m := RoutingMode(r.Header.Get(routingHeader)); m {
+	case RoutingProxy, RoutingRedirect:
+		return m
+	}
+	return s.routing
+}
+
+// liveLeader returns the leader of the shard, unless it is known to be down
+func (s *Server) liveLeader(shard int) (string, error) {
+	addr := s.leaderAddr(shard)
+	if !s.alive(addr) && s.failover != nil {
+		// gossip gave up on the leader, maybe somebody took over already
+		addr = s.failover.Directory().Refresh(shard)
+	}
+	if !s.alive(addr) {
+		return "", fmt.Errorf("leader %q of shard %d is down", addr, shard)
+	}
+	return addr, nil
+}
+
+// proxyToLeader passes the request on to the leader of the shard, an error means the shard is unavailable
+// and nothing was written to w
+func (s *Server) proxyToLeader(shard int, w http.ResponseWriter, r *http.Request) error {
+	addr, err := s.liveLeader(shard)
+	if err != nil {
+		return err
+	}
+
+	body := &unreadBody{ReadCloser: r.Body}
+	if r.Body != nil {
+		r.Body = body
+	}
+	w.Header().Set(ownerHeader, addr)
+	err = s.proxyTo(addr, w, r)
+	if err != nil && s.failover != nil && !body.read && !errors.Is(err, ErrTopologyMismatch) {
+		// the leader may have failed over, ask the shard who leads it now and try once more
+		if newAddr := s.failover.Directory().Refresh(shard); newAddr != addr {
+			w.Header().Set(ownerHeader, newAddr)
+			err = s.proxyTo(newAddr, w, r)
+		}
+	}
+	if err != nil {
+		w.Header().Del(ownerHeader)
+	}
+	return err
+}
+
+// unreadBody lets a request body be sent again after an attempt that failed before reading any of it
+type unreadBody struct {
+	io.ReadCloser
+	read bool
+}
+
+func (b *unreadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.read = true
+	}
+	return n, err
+}
+
+// Close leaves the body alone, the server closes it once the handler returns
+func (b *unreadBody) Close() error {
+	return nil
+}
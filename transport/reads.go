@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// reads are spread round-robin over every node of the key's shard, leader and replicas alike,
+// skipping the ones gossip found dead
+// a replica only serves a read if its data is at most max_staleness behind the leader,
+// otherwise it hands the read to the leader
+
+// DefaultMaxStaleness is how far behind the leader a replica may be to serve a read
+// that does not set max_staleness.
+const DefaultMaxStaleness = 5 * time.Second
+
+// forwardedHeader is set on requests one node passes to another, it holds the sender's address if it knows it.
+// A forwarded read is served by the node it reaches instead of being routed again.
+const forwardedHeader = "X-KV-Forwarded"
+
+// isForwarded tells whether r came from another node, the header may be empty
+func isForwarded(r *http.Request) bool {
+	return len(r.Header.Values(forwardedHeader)) > 0
+}
+
+// SetMaxStaleness sets the staleness bound of reads that do not set max_staleness,
+// 0 sends all reads to the leader. Must be called before serving.
+func (s *Server) SetMaxStaleness(d time.Duration) {
+	s.maxStaleness = d
+}
+
+// self returns our own address, "" when there is no way to know it
+func (s *Server) self() string {
+	if s.failover != nil {
+		return s.failover.Self()
+	}
+	if !s.db.ReadOnly() {
+		return s.topology().Addrs[s.topology().CurIdx]
+	}
+	return ""
+}
+
+// shardNodes returns the addresses of the leader and all replicas of the shard
+func (s *Server) shardNodes(shard int) []string {
+	if s.failover != nil {
+		return s.failover.Directory().Candidates(shard)
+	}
+	return append([]string{s.topology().Addrs[shard]}, s.topology().Replicas[shard]...)
+}
+
+// readStaleness returns the staleness bound of a read
+func (s *Server) readStaleness(param string) (time.Duration, error) {
+	if param == "" {
+		return s.maxStaleness, nil
+	}
+	d, err := time.ParseDuration(param)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("max_staleness must not be negative, got %s", d)
+	}
+	return d, err
+}
+
+// nextReadNode picks the node of the shard the next read goes to
+func (s *Server) nextReadNode(shard int, maxStaleness time.Duration) string {
+	if maxStaleness == 0 {
+		return s.leaderAddr(shard)
+	}
+	var nodes []string
+	for _, addr := range s.shardNodes(shard) {
+		if s.alive(addr) {
+			nodes = append(nodes, addr)
+		}
+	}
+	if len(nodes) == 0 {
+		return s.leaderAddr(shard)
+	}
+	return nodes[s.readCounter.Add(1)%uint64(len(nodes))]
+}
+
+// freshEnough tells whether our own data may serve a read of our shard with the given staleness bound
+func (s *Server) freshEnough(maxStaleness time.Duration) bool {
+	if s.isLocalLeader() {
+		return true
+	}
+	c := s.replicationClient.Load()
+	if c == nil || maxStaleness == 0 {
+		return false
+	}
+	staleness, ok := c.Staleness()
+	return ok && staleness <= maxStaleness
+}
@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/config"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// the shard layout can change while the node runs, from a SIGHUP, a change of the config file
+// or a config pushed to /admin/reload
+// replicas and addresses may change at will, a change of which shard owns which key is only taken
+// if the new config splits shards of the current one, i.e. a migration is in progress
+// that is safe everywhere but on a parent's leader: a new shard forwards everything to its parent until
+// the cut-over, so nodes may route to it early, but the parent itself has to go through /reshard/cutover
+
+// SetConfigFile tells ReloadConfig where the config lives and which shard this node runs.
+// Must be called before serving.
+func (s *Server) SetConfigFile(path, shardName string) {
+	s.configFile = path
+	s.shardName = shardName
+}
+
+// ReloadConfig reads the config file again and switches to it, see ApplyConfig.
+func (s *Server) ReloadConfig() error {
+	if s.configFile == "" {
+		return errors.New("no config file to reload")
+	}
+	cfg, err := config.ParseFile(s.configFile)
+	if err != nil {
+		return err
+	}
+	return s.ApplyConfig(cfg)
+}
+
+// ApplyConfig validates cfg and swaps it in for the current shard layout.
+func (s *Server) ApplyConfig(cfg config.Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	next, err := config.ParseConfig(cfg, s.shardName)
+	if err != nil {
+		return err
+	}
+	prev := s.topology()
+	if next.CurIdx != prev.CurIdx {
+		return fmt.Errorf("shard %q moves from index %d to %d", s.shardName, prev.CurIdx, next.CurIdx)
+	}
+	if err := config.ValidateEpoch(prev, next); err != nil {
+		return err
+	}
+
+	if !config.SameOwnership(prev, next) {
+		if err := config.ValidateSplit(prev, next); err != nil {
+			return fmt.Errorf("the new config moves keys between shards without a split in progress: %w", err)
+		}
+		if len(next.Children(next.CurIdx)) > 0 && !s.db.ReadOnly() {
+			return fmt.Errorf("shard %d is being split, its leader switches with /reshard/cutover", next.CurIdx)
+		}
+	}
+
+	s.setShards(next)
+	log.Printf("Reloaded shard config: epoch %d, %d shards, current shard %d", next.Epoch, next.Count, next.CurIdx)
+	return nil
+}
+
+// ReloadHandler reloads the config file, or applies the config in the body of a POST.
+func (s *Server) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.Method == http.MethodPost {
+		var data []byte
+		var cfg config.Config
+		data, err = io.ReadAll(r.Body)
+		if err == nil {
+			cfg, err = config.Parse(data)
+		}
+		if err == nil {
+			err = s.ApplyConfig(cfg)
+		}
+	} else {
+		err = s.ReloadConfig()
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprintf(w, "Error = %v", err)
+}
+
+// WatchConfig reloads the config file whenever its modification time or size changes,
+// checking every interval until ctx is done.
+func (s *Server) WatchConfig(ctx context.Context, interval time.Duration) {
+	last, _ := os.Stat(s.configFile)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		fi, err := os.Stat(s.configFile)
+		if err != nil {
+			log.Printf("Watching config %q: %v", s.configFile, err)
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+
+		if err := s.ReloadConfig(); err != nil {
+			log.Printf("Config %q changed but was not applied: %v", s.configFile, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"kv/db"
+	"kv/replication"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the replication side of the server: leaders hand out their log and snapshots here,
+// and both roles report on replication progress
+
+func (s *Server) GetNextKeyForReplication(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	res := replication.NextKeyValues{Version: replication.ProtocolVersion, Entries: []replication.NextKeyValue{}}
+
+	if res.Error = replication.CheckVersion(r.Form.Get(replication.VersionParam)); res.Error != nil {
+		writeReplicationResponse(w, http.StatusBadRequest, &res)
+		return
+	}
+
+	replicaID := r.Form.Get("replica")
+	after, err := parseSeq(r.Form.Get("after"))
+	limit := 1
+	if err == nil && r.Form.Get("limit") != "" {
+		limit, err = strconv.Atoi(r.Form.Get("limit"))
+		if err == nil && (limit <= 0 || limit > replication.MaxBatchSize) {
+			err = fmt.Errorf("batch size must be between 1 and %d, got %d", replication.MaxBatchSize, limit)
+		}
+	}
+	var wait time.Duration
+	if err == nil && r.Form.Get("wait") != "" {
+		wait, err = time.ParseDuration(r.Form.Get("wait"))
+		if err == nil && (wait < 0 || wait > replication.MaxLongPollWait) {
+			err = fmt.Errorf("wait must be between 0 and %s, got %s", replication.MaxLongPollWait, wait)
+		}
+	}
+	if err == nil && replicaID == "" {
+		err = errors.New("missing replica")
+	}
+	if err != nil {
+		res.Error = &replication.Error{Code: replication.ErrCodeBadRequest, Message: err.Error()}
+		writeReplicationResponse(w, http.StatusBadRequest, &res)
+		return
+	}
+
+	// the first pull of a replica registers it, from then on the log keeps everything it has not acked
+	// a position the log can't serve must not be registered, the replica gets a snapshot first
+	if s.failover != nil {
+		// a pull keeps our lease on the shard, so does answering one after a long poll
+		s.failover.Pulled(replicaID)
+		defer s.failover.Pulled(replicaID)
+	}
+	err = s.db.CheckReplicationPosition(after)
+	if err == nil {
+		err = s.db.RegisterReplica(replicaID, after)
+	}
+	if errors.Is(err, db.ErrSnapshotRequired) {
+		res.Error = &replication.Error{Code: replication.ErrCodeSnapshotRequired, Message: err.Error()}
+		writeReplicationResponse(w, http.StatusGone, &res)
+		return
+	}
+	var entries []db.LogEntry
+	if err == nil {
+		entries, err = s.waitForReplicationBatch(r.Context(), after, limit, wait)
+	}
+	if err != nil {
+		res.Error = &replication.Error{Code: replication.ErrCodeInternal, Message: err.Error()}
+		writeReplicationResponse(w, http.StatusInternalServerError, &res)
+		return
+	}
+
+	for _, e := range entries {
+		res.Entries = append(res.Entries, replication.NextKeyValue{
+			Seq:     e.Seq,
+			Key:     []byte(e.Key),
+			Value:   e.Value,
+			Deleted: e.Deleted,
+		})
+	}
+	// fmt.Printf("📤 %s: REPLICATION PULL: after=%d, entries=%d\n", s.serverId, after, len(res.Entries))
+	// this gets printed a lot because of the polling, so skipping it
+
+	writeReplicationResponse(w, http.StatusOK, &res)
+}
+
+// waitForReplicationBatch is the long-poll part of the replication pull, when the replica is caught up
+// the request is held open until SetKey commits something new, the wait runs out or the replica goes away
+func (s *Server) waitForReplicationBatch(ctx context.Context, after uint64, limit int, wait time.Duration) ([]db.LogEntry, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		changed := s.db.LogChanged()
+		entries, err := s.db.GetReplicationBatch(after, limit)
+		if err != nil || len(entries) > 0 || wait == 0 {
+			return entries, err
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Server) DeleteReplicationKey(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	res := replication.AckResponse{Version: replication.ProtocolVersion}
+
+	if res.Error = replication.CheckVersion(r.Form.Get(replication.VersionParam)); res.Error != nil {
+		writeReplicationResponse(w, http.StatusBadRequest, &res)
+		return
+	}
+
+	replicaID := r.Form.Get("replica")
+	seq, err := parseSeq(r.Form.Get("seq"))
+	if err == nil && replicaID == "" {
+		err = errors.New("missing replica")
+	}
+	if err != nil {
+		res.Error = &replication.Error{Code: replication.ErrCodeBadRequest, Message: err.Error()}
+		writeReplicationResponse(w, http.StatusBadRequest, &res)
+		return
+	}
+
+	// fmt.Printf("ACK: %s applied up to seq=%d\n", replicaID, seq)
+
+	status := http.StatusOK
+	err = s.db.DeleteReplicationKey(replicaID, seq)
+	switch {
+	case errors.Is(err, db.ErrUnknownSeq):
+		status = http.StatusConflict
+		res.Error = &replication.Error{Code: replication.ErrCodeSeqAhead, Message: err.Error()}
+	case err != nil:
+		status = http.StatusInternalServerError
+		res.Error = &replication.Error{Code: replication.ErrCodeInternal, Message: err.Error()}
+	}
+	if err != nil {
+		log.Printf("Failed to record the ack of replica %q at seq %d: %v", replicaID, seq, err)
+	}
+
+	writeReplicationResponse(w, status, &res)
+}
+
+// SnapshotHandler streams a consistent copy of the database to a replica that is bootstrapping.
+// The replication position the copy corresponds to goes out in the replication.SnapshotSeqHeader header.
+// Errors before the copy starts are sent as a replication.AckResponse.
+func (s *Server) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	res := replication.AckResponse{Version: replication.ProtocolVersion}
+
+	if res.Error = replication.CheckVersion(r.Form.Get(replication.VersionParam)); res.Error != nil {
+		writeReplicationResponse(w, http.StatusBadRequest, &res)
+		return
+	}
+
+	replicaID := r.Form.Get("replica")
+	if replicaID == "" {
+		res.Error = &replication.Error{Code: replication.ErrCodeBadRequest, Message: "missing replica"}
+		writeReplicationResponse(w, http.StatusBadRequest, &res)
+		return
+	}
+
+	// register before taking the snapshot, so the log keeps everything the snapshot does not contain yet
+	// the replica starts over, so whatever position it had before goes
+	seq, err := s.db.LastLogSeq()
+	if err == nil {
+		err = s.db.ResetReplica(replicaID, seq)
+	}
+	if err != nil {
+		res.Error = &replication.Error{Code: replication.ErrCodeInternal, Message: err.Error()}
+		writeReplicationResponse(w, http.StatusInternalServerError, &res)
+		return
+	}
+
+	err = s.db.WriteSnapshot(func(seq uint64, size int64) io.Writer {
+		w.Header().Set(replication.SnapshotSeqHeader, strconv.FormatUint(seq, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		return w
+	})
+	if err != nil {
+		// headers are already out, the replica notices the short body
+		log.Printf("Failed to send a snapshot to replica %q: %v", replicaID, err)
+	}
+}
+
+// ReplicationStatusHandler reports replication progress as JSON, the log and replica positions on a leader
+// and the pull progress on a replica, so stalled replication can be alerted on.
+func (s *Server) ReplicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var status replication.Status
+
+	if c := s.replicationClient.Load(); c != nil {
+		st := c.Status()
+		status.Role = "replica"
+		status.Replica = &st
+	} else {
+		lastSeq, depth, err := s.db.ReplicationLogStats()
+		var positions map[string]uint64
+		if err == nil {
+			positions, err = s.db.ReplicaPositions()
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error: %v", err)
+			return
+		}
+
+		status.Role = "leader"
+		status.Leader = &replication.LeaderStatus{
+			LastSeq:    lastSeq,
+			QueueDepth: depth,
+			Replicas:   make(map[string]replication.ReplicaPosition),
+		}
+		for id, acked := range positions {
+			pos := replication.ReplicaPosition{AckedSeq: acked}
+			if acked < lastSeq {
+				pos.Lag = lastSeq - acked
+			}
+			status.Leader.Replicas[id] = pos
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&status)
+}
+
+// FailoverStateHandler reports who this node believes leads its shard, in which term and how far it got.
+// Other nodes use it to pick the most up-to-date replica and to find a new leader.
+func (s *Server) FailoverStateHandler(w http.ResponseWriter, r *http.Request) {
+	if s.failover == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "error: failover is not set up")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.failover.State())
+}
+
+// ReplicationPositionsHandler returns the acked position of every registered replica as JSON.
+func (s *Server) ReplicationPositionsHandler(w http.ResponseWriter, r *http.Request) {
+	positions, err := s.db.ReplicaPositions()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(positions)
+}
+
+// UnregisterReplicaHandler stops retaining the replication log for a decommissioned replica.
+func (s *Server) UnregisterReplicaHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	replicaID := r.Form.Get("replica")
+	if replicaID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "error: missing replica")
+		return
+	}
+
+	if err := s.db.UnregisterReplica(replicaID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "ok")
+}
+
+func writeReplicationResponse(w http.ResponseWriter, status int, res any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// parseSeq parses a replication log sequence number, a missing value means 0
+func parseSeq(v string) (uint64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sequence number %q: %w", v, err)
+	}
+	return seq, nil
+}
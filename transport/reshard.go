@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"kv/config"
+	"kv/membership"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// online shard splits
+// the new config either doubles the shard count with split_from set, shard i keeps its keys that still
+// hash to i and hands the rest to its child i+split_from, or adds range shards with split_of set that
+// take over the end of their parent's range
+//  1. the child starts with the new config, copies its parent like a replica would and forwards
+//     client requests to the parent meanwhile
+//  2. /reshard/cutover on the parent's leader holds writes, waits for the children to ack the last one,
+//     promotes them through /reshard/promote and switches to the new config in one step
+//  3. both sides drop the keys that now belong to the other one
+
+// DefaultCutoverTimeout is how long a cut-over waits for the child to catch up when the request does not say
+const DefaultCutoverTimeout = 30 * time.Second
+
+// SetSplitParent marks this node as a new shard still copying its keys from parent.
+// Client requests go to the parent until the parent cuts over, promoted runs once this node took over.
+// Must be called before serving.
+func (s *Server) SetSplitParent(parent string, promoted func()) {
+	s.splitParent.Store(&parent)
+	s.onPromoted = promoted
+}
+
+// setShards switches routing to a new shard layout
+func (s *Server) setShards(next *config.Shards) {
+	s.shards.Store(next)
+	if s.failover != nil {
+		s.failover.Directory().SetShards(next)
+	}
+	if s.members != nil {
+		s.members.SetAddrs(membership.Addrs(next))
+	}
+	if s.grpc != nil {
+		s.grpc.dropPeers()
+	}
+}
+
+// forwardToSplitParent passes the request to the parent while this node is still copying from it,
+// it returns false once the split is done
+func (s *Server) forwardToSplitParent(w http.ResponseWriter, r *http.Request) bool {
+	parent := s.splitParent.Load()
+	if parent == nil {
+		return false
+	}
+
+	if err := s.proxyTo(*parent, w, r); err != nil {
+		w.WriteHeader(forwardStatus(err, http.StatusBadGateway))
+		fmt.Fprintf(w, "Error forwarding the request to parent shard %q: %v", *parent, err)
+	}
+	return true
+}
+
+// CutoverHandler finishes the split of our shard, config is the path of the new config file on this node.
+func (s *Server) CutoverHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	timeout := DefaultCutoverTimeout
+	var err error
+	if t := r.Form.Get("timeout"); t != "" {
+		timeout, err = time.ParseDuration(t)
+	}
+	// a reload in the middle would undo the switch or be undone by it
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	var next *config.Shards
+	if err == nil {
+		next, err = s.loadSplit(r.Form.Get("config"))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	if s.db.ReadOnly() {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error = only the leader of shard %d can cut over", next.CurIdx)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	children := next.Children(next.CurIdx)
+	s.writeFence.Lock()
+	status, err := s.cutover(ctx, next, children)
+	s.writeFence.Unlock()
+	if err != nil {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+
+	log.Printf("Shard %d split, shards %v took over their share of the keys", next.CurIdx, children)
+	err = s.deleteExtraKeys()
+	fmt.Fprintf(w, "Error = %v, shard %d split into %v", err, next.CurIdx, append([]int{next.CurIdx}, children...))
+}
+
+// loadSplit reads the config at path and checks that it splits our shard
+func (s *Server) loadSplit(path string) (*config.Shards, error) {
+	if path == "" {
+		return nil, errors.New("missing config")
+	}
+	cfg, err := config.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	name, _, err := config.Locate(cfg.Shards, s.self())
+	if err != nil {
+		return nil, err
+	}
+	next, err := config.ParseConfig(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.ValidateEpoch(s.topology(), next); err != nil {
+		return nil, err
+	}
+	if err := config.ValidateSplit(s.topology(), next); err != nil {
+		return nil, err
+	}
+	if len(next.Children(next.CurIdx)) == 0 {
+		return nil, fmt.Errorf("the config splits no shard off shard %d", next.CurIdx)
+	}
+	return next, nil
+}
+
+// cutover hands the children their keys, writes must be fenced
+func (s *Server) cutover(ctx context.Context, next *config.Shards, children []int) (int, error) {
+	seq, err := s.db.LastLogSeq()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	var addrs []string
+	for _, idx := range children {
+		addrs = append(addrs, next.Addrs[idx])
+	}
+	if acked, err := s.waitForAcks(ctx, seq, addrs, len(addrs)); err != nil {
+		return http.StatusGatewayTimeout, fmt.Errorf("only %d of the new shards %q caught up with seq %d: %w", acked, addrs, seq, err)
+	}
+
+	// promoting twice is harmless, so a lost answer is simply asked again
+	u := url.Values{}
+	u.Set("parent", s.self())
+	for _, child := range addrs {
+		for attempt := 1; ; attempt++ {
+			err = s.promoteChild(ctx, child, u)
+			if err == nil || attempt == 3 || ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			// children promoted so far stopped copying from us, they need a fresh database before a retry
+			return http.StatusBadGateway, fmt.Errorf("promoting new shard %q: %w", child, err)
+		}
+	}
+
+	s.setShards(next)
+	for _, child := range addrs {
+		if err := s.db.UnregisterReplica(child); err != nil {
+			log.Printf("Failed to unregister new shard %q, it holds back the replication log: %v", child, err)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+func (s *Server) promoteChild(ctx context.Context, child string, u url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+child+"/reshard/promote?"+u.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("answered %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// PromoteSplitHandler is called by the parent once this new shard has all of its keys,
+// from here on this node leads its own shard.
+func (s *Server) PromoteSplitHandler(w http.ResponseWriter, r *http.Request) {
+	parent := s.splitParent.Load()
+	if parent == nil {
+		if done, err := s.db.SplitDone(); err == nil && done {
+			fmt.Fprintf(w, "Error = %v", nil)
+			return
+		}
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Error = shard %d is not being split off a parent", s.topology().CurIdx)
+		return
+	}
+
+	if c := s.replicationClient.Load(); c != nil {
+		c.Stop()
+		s.SetReplicationClient(nil)
+	}
+	if err := s.db.PromoteSplit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Error = %v", err)
+		return
+	}
+	s.splitParent.Store(nil)
+	log.Printf("Took over shard %d from parent %q", s.topology().CurIdx, *parent)
+
+	if s.onPromoted != nil {
+		s.onPromoted()
+	}
+	// the parent is waiting with writes on hold, drop the keys it keeps later
+	go func() {
+		if err := s.deleteExtraKeys(); err != nil {
+			log.Printf("Failed to delete the keys parent %q keeps: %v", *parent, err)
+		}
+	}()
+
+	fmt.Fprintf(w, "Error = %v", nil)
+}
@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"kv/config"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// every node reads its own copy of the config, so two nodes may route keys by different layouts
+// the topology epoch goes along with every forwarded request and every answer to one, a node that
+// sees a newer epoch than its own looks for that layout and takes it like a reload, a node that sees
+// an older one logs it so the stale node can be found
+// the newer layout only ever comes from our own config file or from /cluster/topology of a node in our
+// current layout, never from an address named in a request: X-KV-Forwarded is set by whoever sends it
+
+// epochHeader carries the topology epoch of the node sending a request or an answer.
+const epochHeader = "X-KV-Topology-Epoch"
+
+// topologyFetchTimeout bounds fetching the layout from a peer with a newer epoch
+const topologyFetchTimeout = 5 * time.Second
+
+// TopologyHandler returns the shard layout this node routes by, as JSON.
+func (s *Server) TopologyHandler(w http.ResponseWriter, r *http.Request) {
+	shards := s.topology()
+	w.Header().Set(epochHeader, strconv.FormatUint(shards.Epoch, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shards.Source)
+}
+
+// exchangeEpoch tells the sender of r our epoch and compares it with the sender's
+func (s *Server) exchangeEpoch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(epochHeader, strconv.FormatUint(s.topology().Epoch, 10))
+	// the sender's address is only good for the log, anyone can claim to be a peer
+	s.observeEpoch(r.Header.Get(forwardedHeader), r.Header.Get(epochHeader), false)
+}
+
+// observeEpoch compares the epoch a peer sent with ours, once per peer and epoch
+// reached is whether we picked the peer's address ourselves, as opposed to it naming itself in a request
+func (s *Server) observeEpoch(peer, header string, reached bool) {
+	if header == "" {
+		return
+	}
+	epoch, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		return
+	}
+	ours := s.topology().Epoch
+	if epoch == ours {
+		return
+	}
+
+	// unknown names share one entry, so made up ones can't grow the map
+	known := s.knownNode(peer)
+	key := peer
+	if !known {
+		key = ""
+	}
+	s.epochsMu.Lock()
+	if s.epochsSeen == nil {
+		s.epochsSeen = make(map[string]uint64)
+	}
+	seen, ok := s.epochsSeen[key]
+	s.epochsSeen[key] = epoch
+	s.epochsMu.Unlock()
+	if ok && seen == epoch {
+		return
+	}
+
+	if epoch < ours {
+		log.Printf("Peer %q routes by topology epoch %d, ours is %d", peer, epoch, ours)
+		return
+	}
+	log.Printf("Peer %q routes by topology epoch %d, ours is only %d", peer, epoch, ours)
+	if !reached || !known {
+		peer = ""
+	}
+	if s.syncing.CompareAndSwap(false, true) {
+		go func() {
+			defer s.syncing.Store(false)
+			s.syncTopology(peer, epoch)
+		}()
+	}
+}
+
+// syncTopology looks for a layout of at least epoch, in our config file first and then at peer,
+// or at every node of our layout if peer is ""
+func (s *Server) syncTopology(peer string, epoch uint64) {
+	if s.configFile != "" {
+		if err := s.ReloadConfig(); err != nil {
+			log.Printf("Reloading config %q for topology epoch %d: %v", s.configFile, epoch, err)
+		}
+		if s.topology().Epoch >= epoch {
+			return
+		}
+	}
+
+	sources := []string{peer}
+	if peer == "" {
+		sources = s.topologyNodes()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), topologyFetchTimeout)
+	defer cancel()
+
+	for _, addr := range sources {
+		if addr == s.self() {
+			continue
+		}
+		cfg, err := fetchTopology(ctx, addr)
+		if err == nil && cfg.Epoch < epoch {
+			continue
+		}
+		if err == nil {
+			err = s.ApplyConfig(cfg)
+		}
+		if err != nil {
+			log.Printf("Taking the topology of %q failed: %v", addr, err)
+			continue
+		}
+		return
+	}
+	log.Printf("No node of topology epoch %d has a layout of epoch %d", s.topology().Epoch, epoch)
+}
+
+// topologyNodes returns the leaders and replicas of every shard in our layout
+func (s *Server) topologyNodes() []string {
+	shards := s.topology()
+	var addrs []string
+	for idx := 0; idx < shards.Count; idx++ {
+		addrs = append(addrs, shards.Addrs[idx])
+		addrs = append(addrs, shards.Replicas[idx]...)
+	}
+	return addrs
+}
+
+// knownNode tells whether addr is a node of our layout
+func (s *Server) knownNode(addr string) bool {
+	return addr != "" && slices.Contains(s.topologyNodes(), addr)
+}
+
+// fetchTopology reads the shard layout of the node at addr
+func fetchTopology(ctx context.Context, addr string) (config.Config, error) {
+	var cfg config.Config
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/cluster/topology", nil)
+	if err != nil {
+		return cfg, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return cfg, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return cfg, fmt.Errorf("%s answered %s", addr, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&cfg)
+	return cfg, err
+}
@@ -1,52 +1,151 @@
 package transport
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"kv/config"
 	"kv/db"
+	"kv/failover"
+	"kv/membership"
 	"kv/replication"
 	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
 	db       *db.Database
-	shards   *config.Shards
-	serverId string // this is simply to be able to identify the server in logs
+	shards   atomic.Pointer[config.Shards] // swapped as a whole when resharding cuts over
+	serverId string                        // this is simply to be able to identify the server in logs
+
+	replicationClient atomic.Pointer[replication.Client] // only set while this node is a replica
+	proxy             *httputil.ReverseProxy             // passes on the requests other nodes serve
+	routing           RoutingMode                        // used when a request does not pick one
+	failover          *failover.Node                     // nil when failover is not set up, leaders then come from the config
+	members           *membership.List                   // nil when gossip is off, every node then counts as alive
+	grpc              *grpcService                       // nil when gRPC is not served
+
+	durability        replication.Durability // used when a write does not ask for a level itself
+	durabilityTimeout time.Duration          // 0 waits as long as the client stays connected
+
+	maxValueSize int64         // largest value a PUT to /v1/keys may store
+	maxStaleness time.Duration // staleness bound of reads that do not set one
+	readCounter  atomic.Uint64 // spreads reads over the nodes of a shard
+
+	// writes hold writeFence for reading while they route and apply, a cut-over takes it
+	// for writing so no write lands on the old topology after the new shard caught up
+	writeFence  sync.RWMutex
+	splitParent atomic.Pointer[string] // address of the parent while this new shard copies its keys
+	onPromoted  func()
+
+	configFile string
+	shardName  string
+	reloadMu   sync.Mutex // one config change at a time
+
+	epochsMu   sync.Mutex
+	epochsSeen map[string]uint64 // last topology epoch each peer sent that differed from ours
+	syncing    atomic.Bool       // a newer layout is being looked for
 }
 
 func NewServer(db *db.Database, s *config.Shards, id string) *Server {
-	return &Server{
-		db:       db,
-		shards:   s,
-		serverId: id,
+	srv := &Server{
+		db:           db,
+		serverId:     id,
+		durability:   replication.DurabilityAsync,
+		maxStaleness: DefaultMaxStaleness,
+		maxValueSize: DefaultMaxValueSize,
+		routing:      RoutingProxy,
 	}
+	srv.shards.Store(s)
+	srv.proxy = srv.newProxy()
+	return srv
 }
 
-func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
-	url := "http://" + s.shards.Addrs[shard] + r.RequestURI
-	fmt.Fprintf(w, "redirecting from shard %d to shard %d (%q)\n", s.shards.CurIdx, shard, url)
+// topology returns the shard layout requests are routed by right now
+func (s *Server) topology() *config.Shards {
+	return s.shards.Load()
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "Error redirecting the request: %v", err)
-		return
+// SetReplicationClient marks this server as a replica pulling through c, its progress shows up in /replication/status.
+// Failover may swap it out at any time, nil marks the server as a leader again.
+func (s *Server) SetReplicationClient(c *replication.Client) {
+	s.replicationClient.Store(c)
+}
+
+// SetFailover lets routing follow leader changes seen by n, must be called before serving.
+func (s *Server) SetFailover(n *failover.Node) {
+	s.failover = n
+}
+
+// leaderAddr returns the address of the node currently leading the shard
+func (s *Server) leaderAddr(shard int) string {
+	if s.failover != nil {
+		return s.failover.Directory().Leader(shard)
 	}
-	defer resp.Body.Close()
+	return s.topology().Addrs[shard]
+}
 
-	io.Copy(w, resp.Body)
+// isLocalLeader tells whether writes for our own shard are served right here,
+// a replica hands them to its leader instead
+func (s *Server) isLocalLeader() bool {
+	if !s.db.ReadOnly() {
+		return true
+	}
+	// nowhere to send them, let the database refuse
+	return s.failover != nil && s.leaderAddr(s.topology().CurIdx) == s.failover.Self()
 }
 
-func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
+// parseForm reads the query and a form body, and puts the body back so the request can still be passed on
+func parseForm(r *http.Request) {
 	r.ParseForm()
+	if len(r.PostForm) > 0 {
+		body := r.PostForm.Encode()
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+}
+
+// redirect hands the request to the leader of the shard, see toLeader
+func (s *Server) redirect(shard int, w http.ResponseWriter, r *http.Request) {
+	if err := s.toLeader(shard, w, r); err != nil {
+		w.WriteHeader(forwardStatus(err, http.StatusServiceUnavailable))
+		fmt.Fprintf(w, "Error redirecting the request: %v", err)
+	}
+}
+
+func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
+	parseForm(r)
 	key := r.Form.Get("key")
-	shard := s.shards.Index(key)
+	shards := s.topology()
+	shard := shards.Index(key)
+	s.exchangeEpoch(w, r)
+
+	// fmt.Printf("➡️ GET /get?key=%s → target shard: %d | current shard: %d\n", key, shard, shards.CurIdx)
 
-	// fmt.Printf("➡️ GET /get?key=%s → target shard: %d | current shard: %d\n", key, shard, s.shards.CurIdx)
+	if s.forwardToSplitParent(w, r) {
+		return
+	}
 
-	if shard != s.shards.CurIdx {
+	maxStaleness, err := s.readStaleness(r.Form.Get("max_staleness"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Shard = %d, current shard = %d, addr = %q, Value = %q, error = %v", shard, shards.CurIdx, shards.Addrs[shard], "", err)
+		return
+	}
+
+	if shard != shards.CurIdx || !s.freshEnough(maxStaleness) {
+		// a forwarded read already reached the node picked for it
+		if !isForwarded(r) {
+			addr := s.nextReadNode(shard, maxStaleness)
+			if addr != s.self() && addr != s.leaderAddr(shard) && s.proxyTo(addr, w, r) == nil {
+				return
+			}
+			// the leader or an unreachable replica, the leader goes through the usual path below
+		}
 		// fmt.Println("🔁 Redirecting GET request to correct shard")
 		s.redirect(shard, w, r)
 		return
@@ -54,70 +153,112 @@ func (s *Server) GetHandler(w http.ResponseWriter, r *http.Request) {
 
 	value, err := s.db.GetKey(key)
 	// fmt.Printf("✅ GET served locally: key=%s, value=%s, error=%v\n", key, value, err)
+	if errors.Is(err, db.ErrNotFound) {
+		// never set, as opposed to Value = "" with no error for a key set to an empty value
+		w.WriteHeader(http.StatusNotFound)
+	}
 
-	fmt.Fprintf(w, "Shard = %d, current shard = %d, addr = %q, Value = %q, error = %v", shard, s.shards.CurIdx, s.shards.Addrs[shard], value, err)
+	fmt.Fprintf(w, "Shard = %d, current shard = %d, addr = %q, Value = %q, error = %v", shard, shards.CurIdx, shards.Addrs[shard], value, err)
 }
 
 func (s *Server) SetHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
+	parseForm(r)
 	key := r.Form.Get("key")
 	value := r.Form.Get("value")
-	shard := s.shards.Index(key)
+	s.exchangeEpoch(w, r)
+
+	if s.forwardToSplitParent(w, r) {
+		return
+	}
+
+	// routing and the write have to see the same topology, a cut-over waits for both
+	s.writeFence.RLock()
+	shards := s.topology()
+	shard := shards.Index(key)
 
-	// fmt.Printf("➡️ PUT /set?key=%s&value=%s → target shard: %d | current shard: %d\n", key, value, shard, s.shards.CurIdx)
+	// fmt.Printf("➡️ PUT /set?key=%s&value=%s → target shard: %d | current shard: %d\n", key, value, shard, shards.CurIdx)
 
-	if shard != s.shards.CurIdx {
+	if shard != shards.CurIdx || !s.isLocalLeader() {
+		s.writeFence.RUnlock()
 		// fmt.Println("🔁 Redirecting SET request to correct shard")
 		s.redirect(shard, w, r)
 		return
 	}
 
-	err := s.db.SetKey(key, []byte(value))
+	d, required, err := s.durabilityLevel(r.Form.Get("durability"))
+	if err != nil {
+		s.writeFence.RUnlock()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, shards.CurIdx)
+		return
+	}
+
+	seq, err := s.db.SetKeyWithSeq(key, []byte(value))
+	s.writeFence.RUnlock()
 	// fmt.Printf("✅ SET served locally: key=%s, value=%s, error=%v\n", key, value, err)
+	if err == nil {
+		err = s.waitForDurability(r.Context(), seq, d, required)
+		if err != nil {
+			// the write is on the leader and will still replicate, it is just not as durable as asked
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}
 
-	fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, s.shards.CurIdx)
+	fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, shards.CurIdx)
 }
 
-func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request) {
-	// fmt.Printf("🧹 PURGE: Checking for foreign keys on shard %d...\n", s.shards.CurIdx)
-	err := s.db.DeleteExtraKeys(func(key string) bool {
-		shouldDelete := s.shards.Index(key) != s.shards.CurIdx
-		// if shouldDelete {
-		// 	// fmt.Printf("🗑️  Purging key=%s (belongs to shard %d)\n", key, s.shards.Index(key))
-		// }
-		return shouldDelete
-	})
-	fmt.Fprintf(w, "Error = %v", err)
-}
-
-func (s *Server) GetNextKeyForReplication(w http.ResponseWriter, r *http.Request) {
-	k, v, err := s.db.GetNextKeyForReplication()
-	// fmt.Printf("📤 %s: REPLICATION PULL: key=%s, value=%s, err=%v\n", s.serverId, k, v, err)
-	// this gets printed a lot because of the polling, so skipping it
+func (s *Server) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	parseForm(r)
+	key := r.Form.Get("key")
+	s.exchangeEpoch(w, r)
 
-	enc := json.NewEncoder(w)
-	enc.Encode(&replication.NextKeyValue{
-		Key:   string(k),
-		Value: string(v),
-		Err:   err,
-	})
-}
+	if s.forwardToSplitParent(w, r) {
+		return
+	}
 
-func (s *Server) DeleteReplicationKey(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm()
-	key := r.Form.Get("key")
-	value := r.Form.Get("value")
+	s.writeFence.RLock()
+	shards := s.topology()
+	shard := shards.Index(key)
 
-	// fmt.Printf("ACK: Deleting key=%s, value=%s from queue\n", key, value)
+	if shard != shards.CurIdx || !s.isLocalLeader() {
+		s.writeFence.RUnlock()
+		s.redirect(shard, w, r)
+		return
+	}
 
-	err := s.db.DeleteReplicationKey([]byte(key), []byte(value))
+	d, required, err := s.durabilityLevel(r.Form.Get("durability"))
 	if err != nil {
-		fmt.Printf("❌ REPLICATION DELETE failed: %v\n", err)
-		w.WriteHeader(http.StatusExpectationFailed)
-		fmt.Fprintf(w, "error: %v", err)
+		s.writeFence.RUnlock()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, shards.CurIdx)
 		return
 	}
 
-	// fmt.Println("✅ REPLICATION DELETE successful")
-	fmt.Fprintf(w, "ok")
+	seq, err := s.db.DeleteKeyWithSeq(key)
+	s.writeFence.RUnlock()
+	if err == nil {
+		err = s.waitForDurability(r.Context(), seq, d, required)
+		if err != nil {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}
+
+	fmt.Fprintf(w, "Error = %v, shardIdx = %d, current shard = %d", err, shard, shards.CurIdx)
+}
+
+func (s *Server) DeleteExtraKeysHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Error = %v", s.deleteExtraKeys())
+}
+
+// deleteExtraKeys drops every key the current topology places on another shard
+func (s *Server) deleteExtraKeys() error {
+	shards := s.topology()
+	// fmt.Printf("🧹 PURGE: Checking for foreign keys on shard %d...\n", shards.CurIdx)
+	return s.db.DeleteExtraKeys(func(key string) bool {
+		shouldDelete := shards.Index(key) != shards.CurIdx
+		// if shouldDelete {
+		// 	// fmt.Printf("🗑️  Purging key=%s (belongs to shard %d)\n", key, shards.Index(key))
+		// }
+		return shouldDelete
+	})
 }
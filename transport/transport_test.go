@@ -1,18 +1,34 @@
 package transport_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"kv/config"
 	"kv/db"
+	"kv/failover"
+	"kv/kvpb"
+	"kv/membership"
+	"kv/replication"
 	"kv/transport"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 // createShardDB creates a new shard database for testing.
@@ -46,8 +62,8 @@ func createShardServer(t *testing.T, idx int, addrs map[int]string) (*db.Databas
 }
 
 func TestWebServer_ShardsAndRedirect(t *testing.T) {
-	var ts1GetHandler, ts1SetHandler func(http.ResponseWriter, *http.Request)
-	var ts2GetHandler, ts2SetHandler func(http.ResponseWriter, *http.Request)
+	var ts1GetHandler, ts1SetHandler, ts1DeleteHandler func(http.ResponseWriter, *http.Request)
+	var ts2GetHandler, ts2SetHandler, ts2DeleteHandler func(http.ResponseWriter, *http.Request)
 
 	ts1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch {
@@ -55,6 +71,8 @@ func TestWebServer_ShardsAndRedirect(t *testing.T) {
 			ts1GetHandler(w, r)
 		case strings.HasPrefix(r.RequestURI, "/set"):
 			ts1SetHandler(w, r)
+		case strings.HasPrefix(r.RequestURI, "/delete"):
+			ts1DeleteHandler(w, r)
 		default:
 			http.NotFound(w, r)
 		}
@@ -67,6 +85,8 @@ func TestWebServer_ShardsAndRedirect(t *testing.T) {
 			ts2GetHandler(w, r)
 		case strings.HasPrefix(r.RequestURI, "/set"):
 			ts2SetHandler(w, r)
+		case strings.HasPrefix(r.RequestURI, "/delete"):
+			ts2DeleteHandler(w, r)
 		default:
 			http.NotFound(w, r)
 		}
@@ -90,6 +110,8 @@ func TestWebServer_ShardsAndRedirect(t *testing.T) {
 	ts1SetHandler = srv1.SetHandler
 	ts2GetHandler = srv2.GetHandler
 	ts2SetHandler = srv2.SetHandler
+	ts1DeleteHandler = srv1.DeleteHandler
+	ts2DeleteHandler = srv2.DeleteHandler
 
 	// Set keys via shard 0 (ts1), expect redirect to correct shard
 	for key := range keys {
@@ -122,4 +144,1563 @@ func TestWebServer_ShardsAndRedirect(t *testing.T) {
 	valBlr, err := db2.GetKey("Blr")
 	require.NoError(t, err)
 	require.Equal(t, []byte("value-Blr"), valBlr)
+
+	// Delete the key owned by shard 1 through shard 0
+	resp, err := http.Get(fmt.Sprintf("%s/delete?key=Blr", ts1.URL))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	_, err = db2.GetKey("Blr")
+	require.ErrorIs(t, err, db.ErrNotFound)
+}
+
+func TestReplicationBatchHandler(t *testing.T) {
+	leader, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, leader.SetKey(fmt.Sprintf("key-%d", i), []byte("v")))
+	}
+
+	pull := func(query string) replication.NextKeyValues {
+		rec := httptest.NewRecorder()
+		srv.GetNextKeyForReplication(rec, httptest.NewRequest("GET", "/next-replication-key?version=2&"+query, nil))
+		var res replication.NextKeyValues
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		return res
+	}
+
+	res := pull("replica=r1&after=0&limit=2")
+	require.Len(t, res.Entries, 2)
+	require.Equal(t, "key-0", string(res.Entries[0].Key))
+	require.Equal(t, uint64(2), res.Entries[1].Seq)
+
+	res = pull("replica=r1&after=2&limit=2")
+	require.Len(t, res.Entries, 1)
+	require.Equal(t, uint64(3), res.Entries[0].Seq)
+
+	// one ack covers the whole batch
+	rec := httptest.NewRecorder()
+	srv.DeleteReplicationKey(rec, httptest.NewRequest("GET", "/delete-replication-key?version=2&replica=r1&seq=3", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	res = pull("replica=r1&after=0&limit=10")
+	require.Empty(t, res.Entries)
+
+	positions, err := leader.ReplicaPositions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"r1": 3}, positions)
+}
+
+func TestReplicationLongPoll(t *testing.T) {
+	leader, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+
+	// nothing to replicate, the leader gives up after the wait
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	srv.GetNextKeyForReplication(rec, httptest.NewRequest("GET", "/next-replication-key?version=2&replica=r1&limit=10&wait=50ms", nil))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	var res replication.NextKeyValues
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Empty(t, res.Entries)
+
+	// a write while the pull is held open is pushed right away
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		leader.SetKey("pushed", []byte("now"))
+	}()
+
+	rec = httptest.NewRecorder()
+	start = time.Now()
+	srv.GetNextKeyForReplication(rec, httptest.NewRequest("GET", "/next-replication-key?version=2&replica=r1&limit=10&wait=10s", nil))
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+	require.Len(t, res.Entries, 1)
+	require.Equal(t, "pushed", string(res.Entries[0].Key))
+}
+
+func TestReplicationSnapshot(t *testing.T) {
+	leader, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, leader.SetKey(fmt.Sprintf("key-%d", i), []byte("v")))
+	}
+
+	// another replica acks everything, so the log alone can no longer bring a new replica up to date
+	require.NoError(t, leader.DeleteReplicationKey("old-replica", 3))
+	// the new one was here before and starts over
+	require.NoError(t, leader.RegisterReplica("new-replica", 0))
+
+	ts := httptest.NewServer(http.HandlerFunc(srv.SnapshotHandler))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/replication/snapshot?version=2&replica=new-replica")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "3", resp.Header.Get(replication.SnapshotSeqHeader))
+	positions, err := leader.ReplicaPositions()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), positions["new-replica"])
+
+	// a write after the snapshot stays in the log for the new replica
+	require.NoError(t, leader.SetKey("key-3", []byte("v")))
+
+	replica := createShardDB(t, 1)
+	ok, err := replica.IsBootstrapped()
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, replica.InstallSnapshot(resp.Body, 3))
+
+	ok, err = replica.IsBootstrapped()
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	v, err := replica.GetKey("key-2")
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+
+	seq, err := replica.LastAppliedSeq()
+	require.NoError(t, err)
+	batch, err := leader.GetReplicationBatch(seq, 10)
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	require.Equal(t, "key-3", batch[0].Key)
+}
+
+func TestReplicationStatus(t *testing.T) {
+	leader, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	require.NoError(t, leader.RegisterReplica("r1", 0))
+	require.NoError(t, leader.RegisterReplica("r2", 0))
+	for i := 0; i < 4; i++ {
+		require.NoError(t, leader.SetKey(fmt.Sprintf("key-%d", i), []byte("v")))
+	}
+	require.NoError(t, leader.DeleteReplicationKey("r1", 4))
+	require.NoError(t, leader.DeleteReplicationKey("r2", 1))
+
+	rec := httptest.NewRecorder()
+	srv.ReplicationStatusHandler(rec, httptest.NewRequest("GET", "/replication/status", nil))
+	var status replication.Status
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+
+	require.Equal(t, "leader", status.Role)
+	require.Nil(t, status.Replica)
+	require.Equal(t, uint64(4), status.Leader.LastSeq)
+	require.Equal(t, 3, status.Leader.QueueDepth)
+	require.Equal(t, map[string]replication.ReplicaPosition{
+		"r1": {AckedSeq: 4, Lag: 0},
+		"r2": {AckedSeq: 1, Lag: 3},
+	}, status.Leader.Replicas)
+
+	// a replica reports its own progress instead
+	replicaDB, replicaSrv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	require.NoError(t, replicaDB.ApplyReplicationBatch([]db.LogEntry{{Seq: 7, Key: "k", Value: []byte("v")}}))
+	c, err := replication.NewClient(replicaDB, "127.0.0.1:0", replication.Options{ReplicaID: "r1"})
+	require.NoError(t, err)
+	replicaSrv.SetReplicationClient(c)
+
+	rec = httptest.NewRecorder()
+	replicaSrv.ReplicationStatusHandler(rec, httptest.NewRequest("GET", "/replication/status", nil))
+	status = replication.Status{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+
+	require.Equal(t, "replica", status.Role)
+	require.Nil(t, status.Leader)
+	require.Equal(t, "r1", status.Replica.ReplicaID)
+	require.Equal(t, uint64(7), status.Replica.LastAppliedSeq)
+	require.Zero(t, status.Replica.ConsecutiveErrors)
+}
+
+func TestReplicationProtocolErrors(t *testing.T) {
+	leader, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.1:0"})
+	// values are binary and may be empty, both have to survive the JSON round trip
+	require.NoError(t, leader.SetKey("bin", []byte{0xff, 0x00, 0xfe}))
+	require.NoError(t, leader.SetKey("empty", []byte{}))
+
+	pull := func(query string) (int, replication.NextKeyValues) {
+		rec := httptest.NewRecorder()
+		srv.GetNextKeyForReplication(rec, httptest.NewRequest("GET", "/next-replication-key?"+query, nil))
+		var res replication.NextKeyValues
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&res))
+		return rec.Code, res
+	}
+
+	code, res := pull("replica=r1")
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, replication.ErrCodeUnsupportedVersion, res.Error.Code)
+
+	code, res = pull("version=2&replica=r1&after=nope")
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, replication.ErrCodeBadRequest, res.Error.Code)
+	require.Equal(t, replication.ProtocolVersion, res.Version)
+
+	code, res = pull("version=2&replica=r1&limit=10")
+	require.Equal(t, http.StatusOK, code)
+	require.Nil(t, res.Error)
+	require.Len(t, res.Entries, 2)
+	require.Equal(t, []byte{0xff, 0x00, 0xfe}, res.Entries[0].Value)
+	require.Empty(t, res.Entries[1].Value)
+	require.False(t, res.Entries[1].Deleted)
+
+	// a replica ahead of the log needs a snapshot and is not registered at that position
+	code, res = pull("version=2&replica=r2&after=10")
+	require.Equal(t, http.StatusGone, code)
+	require.Equal(t, replication.ErrCodeSnapshotRequired, res.Error.Code)
+	positions, err := leader.ReplicaPositions()
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"r1": 0}, positions)
+
+	rec := httptest.NewRecorder()
+	srv.DeleteReplicationKey(rec, httptest.NewRequest("GET", "/delete-replication-key?version=2&replica=r1&seq=99", nil))
+	require.Equal(t, http.StatusConflict, rec.Code)
+	var ack replication.AckResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&ack))
+	require.Equal(t, replication.ErrCodeSeqAhead, ack.Error.Code)
+}
+
+func TestDurableWrites(t *testing.T) {
+	leader := createShardDB(t, 0)
+	shards := &config.Shards{
+		Addrs:    map[int]string{0: "127.0.0.1:0"},
+		Replicas: map[int][]string{0: {"r1", "r2"}},
+		Count:    1,
+		CurIdx:   0,
+	}
+	srv := transport.NewServer(leader, shards, "shard-0")
+	srv.SetDurability(replication.DurabilityAsync, 100*time.Millisecond)
+
+	set := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.SetHandler(rec, httptest.NewRequest("GET", "/set?"+query, nil))
+		return rec
+	}
+
+	// async answers right away
+	rec := set("key=a&value=1")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "Error = <nil>")
+
+	// nobody acks, so the quorum is not reached in time, the write still happened on the leader
+	rec = set("key=b&value=2&durability=quorum")
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	require.Contains(t, rec.Body.String(), "durability quorum not reached: 0 of 1")
+	value, err := leader.GetKey("b")
+	require.NoError(t, err)
+	require.Equal(t, "2", string(value))
+
+	// r1 acks while the write waits
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		leader.DeleteReplicationKey("r1", 3)
+	}()
+	rec = set("key=c&value=3&durability=one")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// all needs r2 as well
+	rec = set("key=d&value=4&durability=all")
+	require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+
+	// a level the shard can never reach is refused before writing
+	shards.Replicas = nil
+	rec = set("key=e&value=5&durability=one")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	_, err = leader.GetKey("e")
+	require.ErrorIs(t, err, db.ErrNotFound)
+
+	rec = set("key=e&value=5&durability=sometimes")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestFailover(t *testing.T) {
+	// a leader and two replicas, every one of them watching the others
+	var tss [3]*httptest.Server
+	var addrs [3]string
+	for i := range tss {
+		tss[i] = httptest.NewUnstartedServer(nil)
+		addrs[i] = tss[i].Listener.Addr().String()
+	}
+	c := config.Config{Shards: []config.Shard{{Name: "a", Idx: 0, Address: addrs[0], Replicas: []string{addrs[1], addrs[2]}}}}
+
+	var dbs [3]*db.Database
+	var nodes [3]*failover.Node
+	for i := range tss {
+		shards, err := config.ParseConfig(c, "a")
+		require.NoError(t, err)
+		dbs[i] = createShardDB(t, i)
+		dbs[i].SetReadOnly(i > 0)
+		srv := transport.NewServer(dbs[i], shards, "a")
+		nodes[i], err = failover.NewNode(dbs[i], failover.NewDirectory(shards), 0, failover.Options{
+			Self:                addrs[i],
+			LeaseTimeout:        300 * time.Millisecond,
+			Replication:         replication.Options{LongPollWait: 100 * time.Millisecond},
+			OnReplicationClient: srv.SetReplicationClient,
+		})
+		require.NoError(t, err)
+		srv.SetFailover(nodes[i])
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("PUT /v1/keys/{key...}", srv.PutKeyHandler)
+		mux.HandleFunc("/next-replication-key", srv.GetNextKeyForReplication)
+		mux.HandleFunc("/delete-replication-key", srv.DeleteReplicationKey)
+		mux.HandleFunc("/replication/snapshot", srv.SnapshotHandler)
+		mux.HandleFunc("/failover/state", srv.FailoverStateHandler)
+		tss[i].Config.Handler = mux
+		tss[i].Start()
+		require.NoError(t, nodes[i].Start())
+		t.Cleanup(nodes[i].Stop)
+		t.Cleanup(tss[i].Close)
+	}
+
+	put := func(addr, key string) int {
+		req, err := http.NewRequest(http.MethodPut, "http://"+addr+"/v1/keys/"+key, strings.NewReader("v"))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	has := func(d *db.Database, key string) func() bool {
+		return func() bool {
+			_, err := d.GetKey(key)
+			return err == nil
+		}
+	}
+
+	require.Equal(t, http.StatusCreated, put(addrs[0], "before"))
+	require.Eventually(t, has(dbs[1], "before"), 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, has(dbs[2], "before"), 5*time.Second, 10*time.Millisecond)
+
+	// the leader drops off the network, a write it takes in the meantime reaches nobody
+	tss[0].Close()
+	require.NoError(t, dbs[0].SetKey("lost", []byte("v")))
+
+	// both replicas are equally far, so the lower address takes over in the next term
+	winner, other := 1, 2
+	if addrs[2] < addrs[1] {
+		winner, other = 2, 1
+	}
+	require.Eventually(t, func() bool { return nodes[winner].State().IsLeader }, 5*time.Second, 10*time.Millisecond)
+	require.False(t, nodes[other].State().IsLeader)
+	term, err := dbs[winner].Term()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), term)
+	// the log goes on from what the new leader applied, so the others keep their positions
+	seq, err := dbs[winner].LastLogSeq()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), seq)
+
+	// the other replica follows it, and the old leader steps down once it sees the newer term
+	require.Eventually(t, func() bool {
+		st := nodes[other].State()
+		return st.Leader == addrs[winner] && st.Term == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		st := nodes[0].State()
+		return !st.IsLeader && st.Leader == addrs[winner] && st.Term == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, dbs[0].ReadOnly())
+
+	// writes go to the new leader, directly or through the replica, and reach everyone
+	require.Equal(t, http.StatusCreated, put(addrs[winner], "after"))
+	require.Equal(t, http.StatusCreated, put(addrs[other], "through-replica"))
+	for _, i := range []int{0, other} {
+		require.Eventually(t, has(dbs[i], "after"), 5*time.Second, 10*time.Millisecond)
+		require.Eventually(t, has(dbs[i], "through-replica"), 5*time.Second, 10*time.Millisecond)
+	}
+	_, err = dbs[0].GetKey("lost")
+	require.ErrorIs(t, err, db.ErrNotFound)
+	_, err = dbs[0].GetKey("before")
+	require.NoError(t, err)
+}
+
+func TestReadRouting(t *testing.T) {
+	var leaderSrv, replicaSrv, otherSrv *transport.Server
+	var leaderReads, replicaReads atomic.Int32 // reads each node served itself or passed on
+	leaderTS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.RequestURI, "/get"):
+			leaderReads.Add(1)
+			leaderSrv.GetHandler(w, r)
+		case strings.HasPrefix(r.RequestURI, "/next-replication-key"):
+			leaderSrv.GetNextKeyForReplication(w, r)
+		case strings.HasPrefix(r.RequestURI, "/delete-replication-key"):
+			leaderSrv.DeleteReplicationKey(w, r)
+		case strings.HasPrefix(r.RequestURI, "/replication/snapshot"):
+			leaderSrv.SnapshotHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer leaderTS.Close()
+	replicaTS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replicaReads.Add(1)
+		replicaSrv.GetHandler(w, r)
+	}))
+	defer replicaTS.Close()
+	// the leader of shard 1, k belongs to shard 0
+	otherTS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherSrv.GetHandler(w, r)
+	}))
+	defer otherTS.Close()
+
+	leaderAddr := strings.TrimPrefix(leaderTS.URL, "http://")
+	replicaAddr := strings.TrimPrefix(replicaTS.URL, "http://")
+	shards := &config.Shards{
+		Addrs:    map[int]string{0: leaderAddr, 1: strings.TrimPrefix(otherTS.URL, "http://")},
+		Replicas: map[int][]string{0: {replicaAddr}},
+		Count:    2,
+		CurIdx:   0,
+	}
+	otherShards := *shards
+	otherShards.CurIdx = 1
+
+	leader := createShardDB(t, 0)
+	replicaDB, closeReplica, err := db.NewDatabase(t.TempDir()+"/replica.bolt", true)
+	require.NoError(t, err)
+	defer closeReplica()
+
+	leaderSrv = transport.NewServer(leader, shards, "leader")
+	replicaSrv = transport.NewServer(replicaDB, shards, "replica")
+	otherSrv = transport.NewServer(createShardDB(t, 1), &otherShards, "other")
+
+	require.NoError(t, leader.SetKey("k", []byte("v")))
+	c, err := replication.NewClient(replicaDB, leaderAddr, replication.Options{ReplicaID: replicaAddr, LongPollWait: time.Second})
+	require.NoError(t, err)
+	go c.Run()
+	defer c.Stop()
+	replicaSrv.SetReplicationClient(c)
+
+	require.Eventually(t, func() bool {
+		_, ok := c.Staleness()
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	get := func(base, query string) string {
+		resp, err := http.Get(base + "/get?" + query)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// the leader serves the reads of its shard itself
+	for i := 0; i < 2; i++ {
+		require.Contains(t, get(leaderTS.URL, "key=k"), `Value = "v"`)
+	}
+	require.Equal(t, int32(2), leaderReads.Load())
+	require.Zero(t, replicaReads.Load())
+
+	// reads through another shard alternate between the replica and the leader
+	for i := 0; i < 4; i++ {
+		body := get(otherTS.URL, "key=k")
+		require.Equal(t, `Shard = 0, current shard = 0, addr = "`+leaderAddr+`", Value = "v", error = <nil>`, body, "nothing but the answer")
+	}
+	require.Equal(t, int32(4), leaderReads.Load())
+	require.Equal(t, int32(2), replicaReads.Load())
+
+	// a zero bound only trusts the leader
+	for i := 0; i < 4; i++ {
+		body := get(otherTS.URL, "key=k&max_staleness=0s")
+		require.Contains(t, body, `Value = "v"`)
+	}
+	require.Equal(t, int32(2), replicaReads.Load())
+
+	// a replica that stopped replicating falls behind the bound and hands the read to the leader
+	c.Stop()
+	time.Sleep(50 * time.Millisecond)
+	leaderReads.Store(0)
+	body := get(replicaTS.URL, "key=k&max_staleness=10ms")
+	require.Contains(t, body, `Value = "v"`)
+	require.Equal(t, int32(1), leaderReads.Load())
+
+	body = get(replicaTS.URL, "key=k&max_staleness=1h")
+	require.Contains(t, body, `Value = "v"`)
+	require.Equal(t, int32(1), leaderReads.Load())
+
+	// a read another node passed on may still go from the replica to its leader, but no further
+	forwarded := func(hops string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, replicaTS.URL+"/get?key=k&max_staleness=10ms", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-KV-Forwarded", "127.0.0.9:8080")
+		req.Header.Set("X-KV-Hops", hops)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	require.Equal(t, http.StatusOK, forwarded("1").StatusCode)
+	require.Equal(t, int32(2), leaderReads.Load())
+	require.Equal(t, http.StatusMisdirectedRequest, forwarded("2").StatusCode)
+	require.Equal(t, int32(2), leaderReads.Load())
+
+	resp, err := http.Get(replicaTS.URL + "/get?key=k&max_staleness=soon")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestReadRouting_LeaderCutOff(t *testing.T) {
+	var leaderSrv, replicaSrv *transport.Server
+	var leaderReads atomic.Int32
+	var cutOff atomic.Bool
+	release := make(chan struct{})
+	leaderTS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.RequestURI, "/get"):
+			leaderReads.Add(1)
+			leaderSrv.GetHandler(w, r)
+		case cutOff.Load():
+			// the replica's pulls disappear as if the leader were partitioned away
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		case strings.HasPrefix(r.RequestURI, "/next-replication-key"):
+			leaderSrv.GetNextKeyForReplication(w, r)
+		case strings.HasPrefix(r.RequestURI, "/delete-replication-key"):
+			leaderSrv.DeleteReplicationKey(w, r)
+		case strings.HasPrefix(r.RequestURI, "/replication/snapshot"):
+			leaderSrv.SnapshotHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer leaderTS.Close()
+	defer close(release)
+	replicaTS := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replicaSrv.GetHandler(w, r)
+	}))
+	defer replicaTS.Close()
+
+	leaderAddr := strings.TrimPrefix(leaderTS.URL, "http://")
+	replicaAddr := strings.TrimPrefix(replicaTS.URL, "http://")
+	shards := &config.Shards{
+		Addrs:    map[int]string{0: leaderAddr},
+		Replicas: map[int][]string{0: {replicaAddr}},
+		Count:    1,
+		CurIdx:   0,
+	}
+
+	leader := createShardDB(t, 0)
+	replicaDB, closeReplica, err := db.NewDatabase(t.TempDir()+"/replica.bolt", true)
+	require.NoError(t, err)
+	defer closeReplica()
+	leaderSrv = transport.NewServer(leader, shards, "leader")
+	replicaSrv = transport.NewServer(replicaDB, shards, "replica")
+
+	require.NoError(t, leader.SetKey("k", []byte("v")))
+	// the long-poll outlasts the staleness bound
+	c, err := replication.NewClient(replicaDB, leaderAddr, replication.Options{ReplicaID: replicaAddr, LongPollWait: 3 * time.Second})
+	require.NoError(t, err)
+	go c.Run()
+	defer c.Stop()
+	replicaSrv.SetReplicationClient(c)
+
+	get := func() {
+		resp, err := http.Get(replicaTS.URL + "/get?key=k&max_staleness=500ms")
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Contains(t, string(body), `Value = "v"`)
+	}
+
+	// right after a long-poll came back empty the replica serves the read itself
+	require.Eventually(t, func() bool {
+		_, ok := c.Staleness()
+		return ok
+	}, 10*time.Second, 10*time.Millisecond)
+	get()
+	require.Zero(t, leaderReads.Load())
+
+	// the leader is cut off, the pull underway breaks and the next ones hang
+	// a held long-poll proves nothing, so the replica stops vouching for its data once the bound runs out
+	cutOff.Store(true)
+	leaderTS.CloseClientConnections()
+	start := time.Now()
+	require.Eventually(t, func() bool {
+		get()
+		return leaderReads.Load() > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Less(t, time.Since(start), 2*time.Second)
+	staleness, ok := c.Staleness()
+	require.True(t, ok)
+	require.Greater(t, staleness, 500*time.Millisecond)
+}
+
+func TestSplitCutover(t *testing.T) {
+	var parentSrv, childSrv *transport.Server
+	mux := func(srv **transport.Server) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s := *srv
+			switch r.URL.Path {
+			case "/get":
+				s.GetHandler(w, r)
+			case "/set":
+				s.SetHandler(w, r)
+			case "/next-replication-key":
+				s.GetNextKeyForReplication(w, r)
+			case "/delete-replication-key":
+				s.DeleteReplicationKey(w, r)
+			case "/replication/snapshot":
+				s.SnapshotHandler(w, r)
+			case "/reshard/cutover":
+				s.CutoverHandler(w, r)
+			case "/reshard/promote":
+				s.PromoteSplitHandler(w, r)
+			default:
+				http.NotFound(w, r)
+			}
+		})
+	}
+	parentTS := httptest.NewServer(mux(&parentSrv))
+	defer parentTS.Close()
+	childTS := httptest.NewServer(mux(&childSrv))
+	defer childTS.Close()
+	parentAddr := strings.TrimPrefix(parentTS.URL, "http://")
+	childAddr := strings.TrimPrefix(childTS.URL, "http://")
+
+	// the parent starts out as the only shard
+	parent, parentSrv := createShardServer(t, 0, map[int]string{0: parentAddr})
+	for i := 0; i < 20; i++ {
+		require.NoError(t, parent.SetKey(fmt.Sprintf("key-%d", i), []byte("before")))
+	}
+
+	configFile := t.TempDir() + "/split.toml"
+	require.NoError(t, os.WriteFile(configFile, []byte(fmt.Sprintf(`
+split_from = 1
+
+[[shards]]
+name = "Hyderabad"
+idx = 0
+address = %q
+
+[[shards]]
+name = "Bangalore"
+idx = 1
+address = %q
+`, parentAddr, childAddr)), 0644))
+	cfg, err := config.ParseFile(configFile)
+	require.NoError(t, err)
+	next, err := config.ParseConfig(cfg, "Bangalore")
+	require.NoError(t, err)
+
+	// the child copies the parent like a replica and sends clients to it meanwhile
+	child, closeChild, err := db.NewDatabase(t.TempDir()+"/child.bolt", true)
+	require.NoError(t, err)
+	defer closeChild()
+	childSrv = transport.NewServer(child, next, "child")
+	c, err := replication.NewClient(child, parentAddr, replication.Options{ReplicaID: childAddr, LongPollWait: time.Second})
+	require.NoError(t, err)
+	childSrv.SetReplicationClient(c)
+	promoted := make(chan struct{})
+	childSrv.SetSplitParent(parentAddr, func() { close(promoted) })
+	go c.Run()
+	defer c.Stop()
+
+	get := func(base, path string) (int, string) {
+		resp, err := http.Get(base + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	// the child has no say over its keys yet, the parent takes the write
+	_, body := get(childTS.URL, "/set?key=key-0&value=during")
+	require.True(t, strings.HasPrefix(body, "Error = <nil>"), body)
+	v, err := parent.GetKey("key-0")
+	require.NoError(t, err)
+	require.Equal(t, "during", string(v))
+
+	// also when another node passed the write on to the child, that is the one hop allowed inside a shard
+	req, err := http.NewRequest(http.MethodGet, childTS.URL+"/set?key=key-1&value=during", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-KV-Forwarded", "127.0.0.9:8080")
+	req.Header.Set("X-KV-Hops", "1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	v, err = parent.GetKey("key-1")
+	require.NoError(t, err)
+	require.Equal(t, "during", string(v))
+
+	before, err := parent.LastLogSeq()
+	require.NoError(t, err)
+	code, body := get(parentTS.URL, "/reshard/cutover?timeout=5s&config="+configFile)
+	require.Equal(t, http.StatusOK, code, body)
+	<-promoted
+	require.False(t, child.ReadOnly())
+
+	// the parent drops the moved keys through its log, so its own replicas drop them too
+	entries, err := parent.GetReplicationBatch(before, 100)
+	require.NoError(t, err)
+	var moved, deleted []string
+	for i := 0; i < 20; i++ {
+		if key := fmt.Sprintf("key-%d", i); next.Index(key) == 1 {
+			moved = append(moved, key)
+		}
+	}
+	for _, e := range entries {
+		require.True(t, e.Deleted)
+		deleted = append(deleted, e.Key)
+	}
+	require.ElementsMatch(t, moved, deleted)
+
+	// every key now lives on exactly the shard the new layout places it on
+	require.Eventually(t, func() bool {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			_, err := parent.GetKey(key)
+			onParent := err == nil
+			_, err = child.GetKey(key)
+			onChild := err == nil
+			if (next.Index(key) == 0) != onParent || (next.Index(key) == 1) != onChild {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the write made through the child during the migration survived the move
+	code, body = get(parentTS.URL, "/get?key=key-0")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, `Value = "during"`)
+
+	// writes through the parent reach the child's keys on the child
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		get(parentTS.URL, "/set?key="+key+"&value=after")
+		if next.Index(key) == 1 {
+			v, err := child.GetKey(key)
+			require.NoError(t, err)
+			require.Equal(t, "after", string(v))
+		}
+	}
+
+	// a repeated promote is harmless, a second cut-over is refused
+	code, _ = get(childTS.URL, "/reshard/promote")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = get(parentTS.URL, "/reshard/cutover?config="+configFile)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestConfigReload(t *testing.T) {
+	writeConfig := func(path, extra string) {
+		require.NoError(t, os.WriteFile(path, []byte(`
+[[shards]]
+name = "Hyderabad"
+idx = 0
+address = "127.0.0.2:8080"
+`+extra+`
+
+[[shards]]
+name = "Bangalore"
+idx = 1
+address = "127.0.0.3:8080"
+`), 0644))
+	}
+	configFile := t.TempDir() + "/sharding.toml"
+	writeConfig(configFile, "")
+
+	cfg, err := config.ParseFile(configFile)
+	require.NoError(t, err)
+	shards, err := config.ParseConfig(cfg, "Hyderabad")
+	require.NoError(t, err)
+	srv := transport.NewServer(createShardDB(t, 0), shards, "shard-0")
+	srv.SetConfigFile(configFile, "Hyderabad")
+	srv.SetDurability(replication.DurabilityAsync, 10*time.Millisecond)
+
+	setWithOneAck := func() int {
+		rec := httptest.NewRecorder()
+		srv.SetHandler(rec, httptest.NewRequest("GET", "/set?key=Hyd&value=1&durability=one", nil))
+		return rec.Code
+	}
+	require.Equal(t, http.StatusBadRequest, setWithOneAck(), "no replica to ack yet")
+
+	// a new replica is picked up from the file
+	writeConfig(configFile, `replicas = ["127.0.0.22:8080"]`)
+	rec := httptest.NewRecorder()
+	srv.ReloadHandler(rec, httptest.NewRequest("GET", "/admin/reload", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, http.StatusGatewayTimeout, setWithOneAck(), "the replica exists now but never acks")
+
+	// changing who owns which key is refused
+	rec = httptest.NewRecorder()
+	srv.ReloadHandler(rec, httptest.NewRequest("POST", "/admin/reload", strings.NewReader(`
+partitioner = "consistent-hash"
+
+[[shards]]
+name = "Hyderabad"
+idx = 0
+address = "127.0.0.2:8080"
+
+[[shards]]
+name = "Bangalore"
+idx = 1
+address = "127.0.0.3:8080"
+`)))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "without a split in progress")
+
+	// so is a split of our own shard on its leader, that takes a cut-over
+	split := `
+split_from = 2
+
+[[shards]]
+name = "Hyderabad"
+idx = 0
+address = "127.0.0.2:8080"
+
+[[shards]]
+name = "Bangalore"
+idx = 1
+address = "127.0.0.3:8080"
+
+[[shards]]
+name = "Mumbai"
+idx = 2
+address = "127.0.0.4:8080"
+
+[[shards]]
+name = "Delhi"
+idx = 3
+address = "127.0.0.5:8080"
+`
+	rec = httptest.NewRecorder()
+	srv.ReloadHandler(rec, httptest.NewRequest("POST", "/admin/reload", strings.NewReader(split)))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Contains(t, rec.Body.String(), "/reshard/cutover")
+
+	// a broken config changes nothing
+	rec = httptest.NewRecorder()
+	srv.ReloadHandler(rec, httptest.NewRequest("POST", "/admin/reload", strings.NewReader(`[[shards]`)))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Equal(t, http.StatusGatewayTimeout, setWithOneAck())
+}
+
+func TestTopologyEpoch(t *testing.T) {
+	var hydSrv, blrSrv *transport.Server
+	mux := func(srv **transport.Server) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s := *srv
+			switch r.URL.Path {
+			case "/get":
+				s.GetHandler(w, r)
+			case "/set":
+				s.SetHandler(w, r)
+			case "/cluster/topology":
+				s.TopologyHandler(w, r)
+			default:
+				http.NotFound(w, r)
+			}
+		})
+	}
+	hydTS := httptest.NewServer(mux(&hydSrv))
+	defer hydTS.Close()
+	blrTS := httptest.NewServer(mux(&blrSrv))
+	defer blrTS.Close()
+	hydAddr := strings.TrimPrefix(hydTS.URL, "http://")
+	blrAddr := strings.TrimPrefix(blrTS.URL, "http://")
+
+	layout := func(epoch int, blrReplica string) string {
+		return fmt.Sprintf(`
+epoch = %d
+
+[[shards]]
+name = "Hyderabad"
+idx = 0
+address = %q
+
+[[shards]]
+name = "Bangalore"
+idx = 1
+address = %q
+replicas = [%q]
+`, epoch, hydAddr, blrAddr, blrReplica)
+	}
+	newServer := func(toml, name string) *transport.Server {
+		cfg, err := config.Parse([]byte(toml))
+		require.NoError(t, err)
+		shards, err := config.ParseConfig(cfg, name)
+		require.NoError(t, err)
+		srv := transport.NewServer(createShardDB(t, shards.CurIdx), shards, name)
+		srv.SetConfigFile("", name)
+		srv.SetMaxStaleness(0)
+		return srv
+	}
+	// Bangalore got the new replica, Hyderabad still runs the old file
+	hydSrv = newServer(layout(1, "127.0.0.33:8080"), "Hyderabad")
+	blrSrv = newServer(layout(2, "127.0.0.34:8080"), "Bangalore")
+
+	resp, err := http.Get(blrTS.URL + "/cluster/topology")
+	require.NoError(t, err)
+	var cfg config.Config
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&cfg))
+	resp.Body.Close()
+	require.Equal(t, uint64(2), cfg.Epoch)
+	require.Equal(t, "2", resp.Header.Get("X-KV-Topology-Epoch"))
+	require.Equal(t, []string{"127.0.0.34:8080"}, cfg.Shards[1].Replicas)
+
+	// a request Hyderabad forwards to Bangalore tells it that its layout is stale
+	key := "key-1"
+	for i := 0; (config.Modulo{Count: 2}).Index(key) != 1; i++ {
+		key = fmt.Sprintf("key-%d", i)
+	}
+	resp, err = http.Get(hydTS.URL + "/set?key=" + key + "&value=v")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	epoch := func() string {
+		resp, err := http.Get(hydTS.URL + "/cluster/topology")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.Header.Get("X-KV-Topology-Epoch")
+	}
+	require.Eventually(t, func() bool { return epoch() == "2" }, 5*time.Second, 10*time.Millisecond)
+
+	// going back to an older epoch is refused
+	old, err := config.Parse([]byte(layout(1, "127.0.0.33:8080")))
+	require.NoError(t, err)
+	require.ErrorContains(t, hydSrv.ApplyConfig(old), "older than")
+	require.Equal(t, "2", epoch())
+
+	// anyone can claim to be a peer with a newer epoch, the layout is never fetched from the claimed address
+	var spoofed atomic.Int32
+	attacker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spoofed.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer attacker.Close()
+	hydKey := "key-0"
+	for i := 0; (config.Modulo{Count: 2}).Index(hydKey) != 0; i++ {
+		hydKey = fmt.Sprintf("key-%d", i)
+	}
+	spoof := func(epoch string) {
+		req, err := http.NewRequest(http.MethodGet, hydTS.URL+"/get?key="+hydKey, nil)
+		require.NoError(t, err)
+		req.Header.Set("X-KV-Forwarded", strings.TrimPrefix(attacker.URL, "http://"))
+		req.Header.Set("X-KV-Topology-Epoch", epoch)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	spoof("5")
+	require.Never(t, func() bool { return epoch() != "2" }, 300*time.Millisecond, 10*time.Millisecond)
+
+	// once a node of its own layout has it, that is where the layout comes from
+	next, err := config.Parse([]byte(layout(3, "127.0.0.35:8080")))
+	require.NoError(t, err)
+	require.NoError(t, blrSrv.ApplyConfig(next))
+	spoof("3")
+	require.Eventually(t, func() bool { return epoch() == "3" }, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, spoofed.Load())
+}
+
+func TestMembershipRouting(t *testing.T) {
+	self, down := "127.0.0.2:8080", "127.0.0.1:1"
+	_, srv := createShardServer(t, 0, map[int]string{0: self, 1: down})
+	members, err := membership.NewList([]string{self, down}, membership.Options{Self: self})
+	require.NoError(t, err)
+	srv.SetMembership(members)
+
+	// another node found shard 1 dead
+	rec := httptest.NewRecorder()
+	srv.GossipHandler(rec, httptest.NewRequest("POST", "/cluster/gossip", strings.NewReader(
+		`{"from": "127.0.0.3:8080", "members": [{"addr": "127.0.0.1:1", "status": "dead"}]}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.MembersHandler(rec, httptest.NewRequest("GET", "/cluster/members", nil))
+	var list []membership.Member
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	require.Len(t, list, 2)
+	require.Equal(t, down, list[0].Addr)
+	require.Equal(t, membership.Dead, list[0].Status)
+	require.Equal(t, membership.Alive, list[1].Status)
+
+	// requests for the dead shard fail right away instead of waiting on the connection
+	key := "key-1"
+	for i := 0; (config.Modulo{Count: 2}).Index(key) != 1; i++ {
+		key = fmt.Sprintf("key-%d", i)
+	}
+	rec = httptest.NewRecorder()
+	srv.GetHandler(rec, httptest.NewRequest("GET", "/get?key="+key+"&max_staleness=0s", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Contains(t, rec.Body.String(), "is down")
+
+	// ping-req only pings members, not whatever address a caller names
+	var hits atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer other.Close()
+	rec = httptest.NewRecorder()
+	srv.PingReqHandler(rec, httptest.NewRequest("POST", "/cluster/ping-req?target="+strings.TrimPrefix(other.URL, "http://"), nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Zero(t, hits.Load())
+	rec = httptest.NewRecorder()
+	srv.PingReqHandler(rec, httptest.NewRequest("POST", "/cluster/ping-req?target="+down, nil))
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+}
+
+func TestKeysAPI(t *testing.T) {
+	var servers [2]*transport.Server
+	var urls [2]string
+	addrs := map[int]string{}
+	for i := range servers {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /v1/keys/{key...}", func(w http.ResponseWriter, r *http.Request) { servers[i].GetKeyHandler(w, r) })
+		mux.HandleFunc("PUT /v1/keys/{key...}", func(w http.ResponseWriter, r *http.Request) { servers[i].PutKeyHandler(w, r) })
+		mux.HandleFunc("DELETE /v1/keys/{key...}", func(w http.ResponseWriter, r *http.Request) { servers[i].DeleteKeyHandler(w, r) })
+		mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) { servers[i].GetHandler(w, r) })
+		mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) { servers[i].SetHandler(w, r) })
+		mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) { servers[i].DeleteHandler(w, r) })
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		urls[i] = ts.URL
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	var dbs [2]*db.Database
+	for i := range servers {
+		dbs[i], servers[i] = createShardServer(t, i, addrs)
+		servers[i].SetMaxValueSize(64)
+	}
+
+	// a key of shard 1 with a slash in it, always asked through shard 0
+	key := "user/1"
+	for i := 0; (config.Modulo{Count: 2}).Index(key) != 1; i++ {
+		key = fmt.Sprintf("user/%d", i)
+	}
+	do := func(method, body string, header ...string) *http.Response {
+		req, err := http.NewRequest(method, urls[0]+"/v1/keys/"+key, strings.NewReader(body))
+		require.NoError(t, err)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	readAll := func(resp *http.Response) string {
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	resp := do("GET", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Contains(t, readAll(resp), `"error":`)
+
+	value := "bin\x00ary\xff"
+	resp = do("PUT", value)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	tag := resp.Header.Get("ETag")
+	require.NotEmpty(t, tag)
+	stored, err := dbs[1].GetKey(key)
+	require.NoError(t, err)
+	require.Equal(t, value, string(stored), "the value lands on shard 1 byte for byte")
+
+	resp = do("GET", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+	require.Equal(t, tag, resp.Header.Get("ETag"))
+	require.Equal(t, value, readAll(resp))
+
+	resp = do("GET", "", "Accept", "application/json")
+	var body struct {
+		Key   string `json:"key"`
+		Value []byte `json:"value"`
+		Shard int    `json:"shard"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, key, body.Key)
+	require.Equal(t, value, string(body.Value))
+	require.Equal(t, 1, body.Shard)
+
+	resp = do("HEAD", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, fmt.Sprint(len(value)), resp.Header.Get("Content-Length"))
+	require.Empty(t, readAll(resp))
+
+	resp = do("GET", "", "If-None-Match", tag)
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// conditional writes
+	require.Equal(t, http.StatusConflict, do("PUT", "v2", "If-None-Match", "*").StatusCode)
+	require.Equal(t, http.StatusPreconditionFailed, do("PUT", "v2", "If-None-Match", tag).StatusCode)
+	require.Equal(t, http.StatusPreconditionFailed, do("PUT", "v2", "If-Match", `"0000000000000000"`).StatusCode)
+	resp = do("PUT", "v2", "If-Match", tag)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.NotEqual(t, tag, resp.Header.Get("ETag"))
+	require.Equal(t, http.StatusPreconditionFailed, do("DELETE", "", "If-Match", tag).StatusCode)
+
+	// straight to the owner, a real server lingers on the connection it had to cut short
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/v1/keys/"+key, strings.NewReader(strings.Repeat("x", 65)))
+	r.SetPathValue("key", key)
+	servers[1].PutKeyHandler(rec, r)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// the old endpoints still see the same data
+	resp, err = http.Get(urls[0] + "/get?key=" + key)
+	require.NoError(t, err)
+	require.Equal(t, `Shard = 1, current shard = 1, addr = "`+addrs[1]+`", Value = "v2", error = <nil>`, readAll(resp), "the answer of shard 1 as is")
+	resp.Body.Close()
+	resp, err = http.Get(urls[0] + "/get?key=" + key + "-missing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "the status of shard 1 as is")
+
+	// a form body still reaches shard 1 after shard 0 read the key from it
+	formKey := "form-1"
+	for i := 0; (config.Modulo{Count: 2}).Index(formKey) != 1; i++ {
+		formKey = fmt.Sprintf("form-%d", i)
+	}
+	resp, err = http.PostForm(urls[0]+"/set", url.Values{"key": {formKey}, "value": {"v"}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, readAll(resp))
+	resp.Body.Close()
+	stored, err = dbs[1].GetKey(formKey)
+	require.NoError(t, err)
+	require.Equal(t, "v", string(stored))
+	resp, err = http.PostForm(urls[0]+"/delete", url.Values{"key": {formKey}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, readAll(resp))
+	resp.Body.Close()
+	_, err = dbs[1].GetKey(formKey)
+	require.ErrorIs(t, err, db.ErrNotFound)
+
+	// a body of unknown length is streamed through
+	req, err := http.NewRequest("PUT", urls[0]+"/v1/keys/"+key, io.NopCloser(strings.NewReader("streamed")))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	stored, err = dbs[1].GetKey(key)
+	require.NoError(t, err)
+	require.Equal(t, "streamed", string(stored))
+
+	require.Equal(t, http.StatusNoContent, do("DELETE", "").StatusCode)
+	require.Equal(t, http.StatusNotFound, do("DELETE", "").StatusCode)
+
+	// a node that does not take writes
+	dbs[1].SetReadOnly(true)
+	resp = do("PUT", "v3")
+	require.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	dbs[1].SetReadOnly(false)
+}
+
+func TestKeysAPI_ShardUnavailable(t *testing.T) {
+	_, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.2:8080", 1: "127.0.0.1:1"})
+
+	key := "key-1"
+	for i := 0; (config.Modulo{Count: 2}).Index(key) != 1; i++ {
+		key = fmt.Sprintf("key-%d", i)
+	}
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		r := httptest.NewRequest(method, "/v1/keys/"+key, strings.NewReader("v"))
+		r.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		switch method {
+		case "GET":
+			srv.GetKeyHandler(rec, r)
+		case "PUT":
+			srv.PutKeyHandler(rec, r)
+		case "DELETE":
+			srv.DeleteKeyHandler(rec, r)
+		}
+		require.Equal(t, http.StatusServiceUnavailable, rec.Code, method)
+		require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestGetMissingVersusEmpty(t *testing.T) {
+	database, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.2:8080"})
+	require.NoError(t, database.SetKey("empty", []byte{}))
+
+	get := func(key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.GetHandler(rec, httptest.NewRequest("GET", "/get?key="+key, nil))
+		return rec
+	}
+	rec := get("empty")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `Value = "", error = <nil>`)
+
+	rec = get("never-set")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Contains(t, rec.Body.String(), "error = key not found")
+
+	getV1 := func(key string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/v1/keys/"+key, nil)
+		r.SetPathValue("key", key)
+		srv.GetKeyHandler(rec, r)
+		return rec
+	}
+	rec = getV1("empty")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "0", rec.Header().Get("Content-Length"))
+	require.Equal(t, http.StatusNotFound, getV1("never-set").Code)
+}
+
+func TestRedirectMode(t *testing.T) {
+	var servers [2]*transport.Server
+	var urls [2]string
+	addrs := map[int]string{}
+	for i := range servers {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /v1/keys/{key...}", func(w http.ResponseWriter, r *http.Request) { servers[i].GetKeyHandler(w, r) })
+		mux.HandleFunc("PUT /v1/keys/{key...}", func(w http.ResponseWriter, r *http.Request) { servers[i].PutKeyHandler(w, r) })
+		mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) { servers[i].SetHandler(w, r) })
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		urls[i] = ts.URL
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	var dbs [2]*db.Database
+	for i := range servers {
+		dbs[i], servers[i] = createShardServer(t, i, addrs)
+	}
+
+	key := "key-1"
+	for i := 0; (config.Modulo{Count: 2}).Index(key) != 1; i++ {
+		key = fmt.Sprintf("key-%d", i)
+	}
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	do := func(c *http.Client, method, url, body string, header ...string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		require.NoError(t, err)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// proxied answers name the owner too
+	resp := do(noFollow, "PUT", urls[0]+"/v1/keys/"+key, "v1")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, addrs[1], resp.Header.Get("X-KV-Shard-Owner"))
+
+	// asked for by the request
+	resp = do(noFollow, "PUT", urls[0]+"/v1/keys/"+key+"?durability=async", "v2", "X-KV-Routing", "redirect")
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	require.Equal(t, addrs[1], resp.Header.Get("X-KV-Shard-Owner"))
+	require.Equal(t, urls[1]+"/v1/keys/"+key+"?durability=async", resp.Header.Get("Location"))
+	value, err := dbs[1].GetKey(key)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(value), "a redirected write is not applied")
+
+	// a client that follows sends the body again
+	resp = do(http.DefaultClient, "PUT", urls[0]+"/v1/keys/"+key, "v2", "X-KV-Routing", "redirect")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	value, err = dbs[1].GetKey(key)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(value))
+
+	// the node's default, which a request can turn off again
+	servers[0].SetRoutingMode(transport.RoutingRedirect)
+	require.Equal(t, http.StatusTemporaryRedirect, do(noFollow, "GET", urls[0]+"/v1/keys/"+key, "").StatusCode)
+	require.Equal(t, http.StatusTemporaryRedirect, do(noFollow, "GET", urls[0]+"/set?key="+key+"&value=v3", "").StatusCode)
+	require.Equal(t, http.StatusOK, do(noFollow, "GET", urls[0]+"/v1/keys/"+key, "", "X-KV-Routing", "proxy").StatusCode)
+
+	// keys of the node's own shard are served as before
+	own := "key-0"
+	for i := 0; (config.Modulo{Count: 2}).Index(own) != 0; i++ {
+		own = fmt.Sprintf("key-%d", i)
+	}
+	resp = do(noFollow, "PUT", urls[0]+"/v1/keys/"+own, "v")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("X-KV-Shard-Owner"))
+
+	// a request another node passed on is not redirected, nor passed on again to another shard
+	resp = do(noFollow, "PUT", urls[0]+"/v1/keys/"+key, "w", "X-KV-Forwarded", "127.0.0.9:8080", "X-KV-Routing", "redirect")
+	require.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Location"))
+
+	_, err = transport.ParseRoutingMode("bounce")
+	require.Error(t, err)
+}
+
+func TestTopologyMismatch(t *testing.T) {
+	var servers [2]*transport.Server
+	var urls [2]string
+	addrs := map[int]string{}
+	for i := range servers {
+		mux := http.NewServeMux()
+		mux.HandleFunc("PUT /v1/keys/{key...}", func(w http.ResponseWriter, r *http.Request) { servers[i].PutKeyHandler(w, r) })
+		mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) { servers[i].SetHandler(w, r) })
+		ts := httptest.NewServer(mux)
+		t.Cleanup(ts.Close)
+		urls[i] = ts.URL
+		addrs[i] = strings.TrimPrefix(ts.URL, "http://")
+	}
+	// both nodes take themselves for shard 0 and the other one for shard 1
+	dbs := [2]*db.Database{createShardDB(t, 0), createShardDB(t, 1)}
+	for i := range servers {
+		servers[i] = transport.NewServer(dbs[i], &config.Shards{
+			Addrs:  map[int]string{0: addrs[i], 1: addrs[1-i]},
+			Count:  2,
+			CurIdx: 0,
+		}, fmt.Sprintf("shard-%d", i))
+	}
+
+	key := "key-1"
+	for i := 0; (config.Modulo{Count: 2}).Index(key) != 1; i++ {
+		key = fmt.Sprintf("key-%d", i)
+	}
+
+	// the request goes over once and comes back with an error instead of bouncing
+	resp, err := http.Get(urls[0] + "/set?key=" + key + "&value=v")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	require.Contains(t, string(body), "topology mismatch")
+	require.Contains(t, string(body), "configs differ under the same epoch")
+
+	req, err := http.NewRequest("PUT", urls[1]+"/v1/keys/"+key, strings.NewReader("v"))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	require.Contains(t, string(body), `"error":"topology mismatch`)
+
+	for _, d := range dbs {
+		_, err := d.GetKey(key)
+		require.ErrorIs(t, err, db.ErrNotFound)
+	}
+
+	// a node that takes itself for the leader it is not passes the request to itself, but not forever
+	dbs[0].SetReadOnly(true)
+	own := "key-0"
+	for i := 0; (config.Modulo{Count: 2}).Index(own) != 0; i++ {
+		own = fmt.Sprintf("key-%d", i)
+	}
+	resp, err = http.Get(urls[0] + "/set?key=" + own + "&value=v")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+	require.Contains(t, string(body), "passed on 2 times already")
+}
+
+func TestScan(t *testing.T) {
+	database, srv := createShardServer(t, 0, map[int]string{0: "127.0.0.2:8080", 1: "127.0.0.3:8080"})
+	var keys []string
+	for i := 0; len(keys) < 5; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		if (config.Modulo{Count: 2}).Index(key) == 0 {
+			keys = append(keys, key)
+		}
+		// keys of the other shard left over from before a split are not ours to return
+		require.NoError(t, database.SetKey(key, []byte("v"+key)))
+	}
+
+	scan := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.ScanHandler(rec, httptest.NewRequest("GET", "/v1/keys?"+query, nil))
+		return rec
+	}
+	type page struct {
+		Shard   int `json:"shard"`
+		Entries []struct {
+			Key   string `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"entries"`
+		Next string `json:"next"`
+	}
+	var got []string
+	next := ""
+	for {
+		rec := scan("limit=2&start=" + next)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var p page
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+		require.LessOrEqual(t, len(p.Entries), 2)
+		for _, e := range p.Entries {
+			require.Equal(t, "v"+e.Key, string(e.Value))
+			got = append(got, e.Key)
+		}
+		if p.Next == "" {
+			break
+		}
+		next = p.Next
+	}
+	require.Equal(t, keys, got)
+
+	rec := scan("start=" + keys[1] + "&end=" + keys[3])
+	var p page
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	require.Len(t, p.Entries, 2)
+	require.Empty(t, p.Next)
+
+	require.Equal(t, http.StatusBadRequest, scan("limit=0").Code)
+}
+
+func TestGRPC(t *testing.T) {
+	// the addresses have to be known before the servers
+	var ls [2]net.Listener
+	addrs := map[int]string{}
+	for i := range ls {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ls[i] = l
+		addrs[i] = l.Addr().String()
+	}
+	var dbs [2]*db.Database
+	var srvs [2]*transport.Server
+	for i := range ls {
+		dbs[i], srvs[i] = createShardServer(t, i, addrs)
+		srv := srvs[i]
+		srv.SetMaxValueSize(16)
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /v1/keys/{key...}", srv.GetKeyHandler)
+		g := grpc.NewServer()
+		srv.RegisterGRPC(g)
+		grpcL, httpL := transport.SplitListener(ls[i])
+		hs := &http.Server{Handler: mux}
+		go g.Serve(grpcL)
+		go hs.Serve(httpL)
+		t.Cleanup(func() { hs.Close() })
+		t.Cleanup(g.Stop)
+	}
+
+	conn, err := grpc.NewClient(addrs[0], grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	kv := kvpb.NewKVClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a watch of both shards, open before anything is written
+	watch, err := kv.Watch(ctx, &kvpb.WatchRequest{Prefix: "k"})
+	require.NoError(t, err)
+	_, err = watch.Header()
+	require.NoError(t, err)
+
+	keyOf := func(shard int) string {
+		for i := 0; ; i++ {
+			if key := fmt.Sprintf("k/%d", i); (config.Modulo{Count: 2}).Index(key) == shard {
+				return key
+			}
+		}
+	}
+	key0, key1 := keyOf(0), keyOf(1)
+	res, err := kv.Set(ctx, &kvpb.SetRequest{Key: key1, Value: []byte("v1\x00")})
+	require.NoError(t, err)
+	require.True(t, res.Created)
+	stored, err := dbs[1].GetKey(key1)
+	require.NoError(t, err)
+	require.Equal(t, "v1\x00", string(stored), "passed on to shard 1")
+	res, err = kv.Set(ctx, &kvpb.SetRequest{Key: key0, Value: []byte("v0")})
+	require.NoError(t, err)
+	res, err = kv.Set(ctx, &kvpb.SetRequest{Key: key0, Value: []byte("v0")})
+	require.NoError(t, err)
+	require.False(t, res.Created)
+
+	got, err := kv.Get(ctx, &kvpb.GetRequest{Key: key1})
+	require.NoError(t, err)
+	require.Equal(t, "v1\x00", string(got.Value))
+	require.Equal(t, int32(1), got.Shard)
+
+	_, err = kv.Get(ctx, &kvpb.GetRequest{Key: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = kv.Get(ctx, &kvpb.GetRequest{Key: key0, MaxStaleness: "soon"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = kv.Set(ctx, &kvpb.SetRequest{Key: key0, Durability: "most"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = kv.Set(ctx, &kvpb.SetRequest{Key: key1, Value: make([]byte, 17)})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, err = kv.Delete(ctx, &kvpb.DeleteRequest{Key: key1})
+	require.NoError(t, err)
+	_, err = kv.Delete(ctx, &kvpb.DeleteRequest{Key: key1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// every write shows up in the watch, each shard's in order
+	var events []string
+	for len(events) < 4 {
+		ev, err := watch.Recv()
+		require.NoError(t, err)
+		events = append(events, fmt.Sprintf("%d %s %s %q", ev.Shard, ev.Type, ev.Key, ev.Value))
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i][0] < events[j][0] })
+	require.Equal(t, []string{
+		fmt.Sprintf("0 SET %s %q", key0, "v0"),
+		fmt.Sprintf("0 SET %s %q", key0, "v0"),
+		fmt.Sprintf("1 SET %s %q", key1, "v1\x00"),
+		fmt.Sprintf("1 DELETE %s %q", key1, ""),
+	}, events)
+
+	batch := &kvpb.BatchSetRequest{}
+	for i := 0; i < 10; i++ {
+		batch.Entries = append(batch.Entries, &kvpb.KeyValue{Key: fmt.Sprintf("s/%02d", i), Value: []byte(fmt.Sprint(i))})
+	}
+	setRes, err := kv.BatchSet(ctx, batch)
+	require.NoError(t, err)
+	require.Len(t, setRes.Results, 10)
+	for _, r := range setRes.Results {
+		require.Empty(t, r.Error)
+		require.True(t, r.Created)
+	}
+
+	getRes, err := kv.BatchGet(ctx, &kvpb.BatchGetRequest{Keys: []string{"s/03", "missing", "s/07"}})
+	require.NoError(t, err)
+	require.Len(t, getRes.Results, 3)
+	require.True(t, getRes.Results[0].Found)
+	require.Equal(t, "3", string(getRes.Results[0].Value))
+	require.False(t, getRes.Results[1].Found)
+	require.Empty(t, getRes.Results[1].Error)
+	require.Equal(t, "7", string(getRes.Results[2].Value))
+
+	// a scan merges both shards in key order
+	scan := func(req *kvpb.ScanRequest) []string {
+		stream, err := kv.Scan(ctx, req)
+		require.NoError(t, err)
+		var keys []string
+		for {
+			kv, err := stream.Recv()
+			if err == io.EOF {
+				return keys
+			}
+			require.NoError(t, err)
+			keys = append(keys, kv.Key+"="+string(kv.Value))
+		}
+	}
+	require.Equal(t, []string{"s/00=0", "s/01=1", "s/02=2", "s/03=3", "s/04=4", "s/05=5", "s/06=6", "s/07=7", "s/08=8", "s/09=9"},
+		scan(&kvpb.ScanRequest{Start: "s/", End: "s0"}))
+	require.Equal(t, []string{"s/04=4", "s/05=5", "s/06=6"}, scan(&kvpb.ScanRequest{Start: "s/04", Limit: 3}))
+
+	// the HTTP API still answers on the same address
+	resp, err := http.Get("http://" + addrs[0] + "/v1/keys/s%2F03")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "3", string(body))
+
+	// shard 1 moves to another node, the watch streaming from the old one ends with its connection
+	recv := make(chan error, 1)
+	go func() {
+		_, err := watch.Recv()
+		recv <- err
+	}()
+	srvs[0].SetConfigFile("", "a")
+	require.NoError(t, srvs[0].ApplyConfig(config.Config{Epoch: 1, Shards: []config.Shard{
+		{Name: "a", Idx: 0, Address: addrs[0]},
+		{Name: "b", Idx: 1, Address: "127.0.0.1:1"},
+	}}))
+	select {
+	case err := <-recv:
+		require.Equal(t, codes.Canceled, status.Code(err), err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the watch still follows the old leader of shard 1")
+	}
 }